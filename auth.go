@@ -0,0 +1,118 @@
+package go_socks5
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+)
+
+// Identity 认证后的身份, 附加在会话上用于过滤规则、日志及统计
+type Identity struct {
+	Method MethodType
+	User   string // 匿名时为空
+}
+
+func (p *Identity) String() string {
+	if p == nil || p.User == "" {
+		return "anonymous"
+	}
+	return p.User
+}
+
+// Authenticator 一种认证方法的子协商
+type Authenticator interface {
+	// Method 认证方法
+	Method() MethodType
+	// Authenticate 在方法选择之后进行子协商, 成功时返回身份
+	Authenticate(rw io.ReadWriter) (*Identity, error)
+}
+
+// CredentialStore 用户名密码校验
+type CredentialStore interface {
+	Valid(user, password string) bool
+}
+
+// CredentialProvider 用户名密码认证方法的凭据, HTTP代理的 Proxy-Authorization 使用同一份凭据.
+// 自定义的 MethodUserPass 认证方法实现该接口后才能用于HTTP代理
+type CredentialProvider interface {
+	CredentialStore() CredentialStore
+}
+
+// StaticCredentials 固定的用户名密码表
+type StaticCredentials map[string]string
+
+// Valid 常量时间比较, 用户不存在时同样进行一次比较
+func (s StaticCredentials) Valid(user, password string) bool {
+	pass, ok := s[user]
+	return secureCompare(pass, password) && ok
+}
+
+// secureCompare 比较摘要, 耗时与内容及长度无关
+func secureCompare(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// NoAuthAuthenticator 不认证
+type NoAuthAuthenticator struct{}
+
+func (a NoAuthAuthenticator) Method() MethodType {
+	return MethodNoAuth
+}
+
+func (a NoAuthAuthenticator) Authenticate(rw io.ReadWriter) (*Identity, error) {
+	return &Identity{Method: MethodNoAuth}, nil
+}
+
+// UserPassAuthenticator 用户名密码认证 (RFC 1929)
+type UserPassAuthenticator struct {
+	Credentials CredentialStore
+	// 兼容子协商版本号使用0x05的旧客户端
+	AllowLegacyVersion bool
+}
+
+func (a UserPassAuthenticator) Method() MethodType {
+	return MethodUserPass
+}
+
+func (a UserPassAuthenticator) CredentialStore() CredentialStore {
+	return a.Credentials
+}
+
+func (a UserPassAuthenticator) Authenticate(rw io.ReadWriter) (*Identity, error) {
+	req, err := NewUserPassAuthReqFrom(rw)
+	if err != nil {
+		return nil, fmt.Errorf("NewUserPassAuthReqFrom:%w", err)
+	}
+
+	switch {
+	case req.Ver == UserPassAuthVersion:
+	case req.Ver == UserPassAuthLegacyVersion && a.AllowLegacyVersion:
+	default:
+		_, _ = rw.Write(NewUserPassAuthReply(AuthStatusFailure).ToBytes())
+		return nil, fmt.Errorf("%w: %#x", ErrAuthUserPassVer, req.Ver)
+	}
+
+	var status byte = AuthStatusFailure
+	if a.Credentials != nil && a.Credentials.Valid(string(req.UserName), string(req.Password)) {
+		status = AuthStatusSuccess
+	}
+
+	// 回复使用请求的版本号
+	reply := NewUserPassAuthReply(status)
+	reply.Ver = req.Ver
+	if _, err = rw.Write(reply.ToBytes()); err != nil {
+		return nil, fmt.Errorf("reply:%w", err)
+	}
+
+	if status != AuthStatusSuccess {
+		return nil, fmt.Errorf("%w: user %q", ErrAuthFailed, req.UserName)
+	}
+
+	return &Identity{
+		Method: MethodUserPass,
+		User:   string(req.UserName),
+	}, nil
+}
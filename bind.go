@@ -0,0 +1,203 @@
+package go_socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+var ErrBindPeer = errors.New("bind: unexpected peer address")
+
+// handleBind RFC 1928 BIND: 监听端口, 第一次回复监听地址, 接受一个连接后第二次回复对端地址, 然后转发
+func (c *connection) handleBind(req *Request) {
+	listener, err := c.listenBind()
+	if err != nil {
+		_ = c.reply(RepServerFailure, nil)
+		c.logger.Printf("bind listen: %v", err)
+		return
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	if !c.setTarget(listener) {
+		return
+	}
+
+	// 第一次回复, 监听的地址
+	bndAddr := listener.Addr().(*net.TCPAddr)
+	if bndAddr.IP.IsUnspecified() {
+		if local, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+			bndAddr = &net.TCPAddr{IP: local.IP, Port: bndAddr.Port}
+		}
+	}
+	bAddr, err := NewAddrByteFromString(bndAddr.String())
+	if err != nil {
+		_ = c.reply(RepServerFailure, nil)
+		c.logger.Println(err)
+		return
+	}
+	if err = c.reply(RepSuccess, bAddr); err != nil {
+		c.logger.Println(err)
+		return
+	}
+
+	stop := c.watchBind(listener)
+	peerConn, err := c.acceptBind(listener, req)
+	if stop() {
+		if peerConn != nil {
+			_ = peerConn.Close()
+		}
+		c.logger.Printf("bind %v: client closed", bndAddr)
+		return
+	}
+	if err != nil {
+		var rep byte = RepServerFailure
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			rep = RepTTLExpired
+		}
+		_ = c.reply(rep, nil)
+		c.logger.Printf("bind %v accept: %v", bndAddr, err)
+		return
+	}
+	defer func() {
+		_ = peerConn.Close()
+	}()
+
+	// 只接受一个连接
+	_ = listener.Close()
+	if !c.setTarget(peerConn) {
+		return
+	}
+
+	// 第二次回复, 连接的对端地址
+	peerAddr, err := NewAddrByteFromString(peerConn.RemoteAddr().String())
+	if err != nil {
+		_ = c.reply(RepServerFailure, nil)
+		c.logger.Println(err)
+		return
+	}
+	if err = c.reply(RepSuccess, peerAddr); err != nil {
+		c.logger.Println(err)
+		return
+	}
+
+	c.logger.Printf("bind %v accept %v", bndAddr, peerConn.RemoteAddr())
+	c.relay(peerConn)
+}
+
+// listenBind 在配置的地址及端口范围内监听, 未配置地址时使用客户端连接的本地地址
+func (c *connection) listenBind() (*net.TCPListener, error) {
+	ip := c.config.bindIP
+	if ip == nil {
+		if local, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+			ip = local.IP
+		}
+	}
+
+	var l *net.TCPListener
+	err := listenPorts(c.config.bindPorts, func(port int) (err error) {
+		l, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		return err
+	})
+	return l, err
+}
+
+// listenPorts 在端口范围内从随机位置开始依次尝试监听, 范围为空时由系统分配端口
+func listenPorts(ports portRange, listen func(port int) error) error {
+	if ports.max == 0 {
+		return listen(0)
+	}
+
+	n := ports.max - ports.min + 1
+	start := rand.Intn(n)
+	var lastErr error
+	for i := 0; i < n; i++ {
+		if lastErr = listen(ports.min + (start+i)%n); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// watchBind 等待对端连接期间读取控制连接, 客户端关闭时关闭监听.
+// 返回的stop停止读取并返回客户端是否已关闭, 读到的数据保留给之后的转发
+func (c *connection) watchBind(listener net.Listener) (stop func() bool) {
+	conn := c.conn
+	done := make(chan struct{})
+
+	var buf [1]byte
+	var n int
+	var closed bool
+	go func() {
+		defer close(done)
+
+		var err error
+		n, err = conn.Read(buf[:])
+		if n == 0 && err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				closed = true
+				_ = listener.Close()
+			}
+		}
+	}()
+
+	return func() bool {
+		_ = conn.SetReadDeadline(time.Now())
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+
+		if n > 0 {
+			c.mu.Lock()
+			c.conn = &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf[:n]), conn)}
+			c.mu.Unlock()
+		}
+		return closed
+	}
+}
+
+// acceptBind 等待对端连接. 配置了BindCheckPeer时只接受来自DST.ADDR的连接
+func (c *connection) acceptBind(listener *net.TCPListener, req *Request) (net.Conn, error) {
+	_ = listener.SetDeadline(time.Now().Add(c.config.BindTimeout))
+
+	var expected []net.IP
+	if c.config.BindCheckPeer {
+		host, _ := req.AddrByte().HostPort()
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() {
+				expected = []net.IP{ip}
+			}
+		} else if len(c.dstIPs) > 0 {
+			// 规则检查时已解析
+			expected = c.dstIPs
+		} else if addrs, err := c.lookup(host); err == nil {
+			expected = addrs
+		} else {
+			return nil, err
+		}
+	}
+
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(expected) == 0 {
+			return conn, nil
+		}
+
+		peerIP := conn.RemoteAddr().(*net.TCPAddr).IP
+		for _, ip := range expected {
+			if ip.Equal(peerIP) {
+				return conn, nil
+			}
+		}
+
+		c.logger.Printf("%v: %v", ErrBindPeer, conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
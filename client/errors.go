@@ -0,0 +1,72 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/general252/go_socks5"
+)
+
+var (
+	ErrNetwork            = errors.New("socks5: network must be tcp, tcp4 or tcp6")
+	ErrVersion            = errors.New("socks5: unexpected server version")
+	ErrNoAcceptableMethod = errors.New("socks5: no acceptable authentication method")
+	ErrAuthFailed         = errors.New("socks5: username/password authentication failed")
+	ErrCredentials        = errors.New("socks5: username and password must be 1-255 bytes")
+)
+
+// ReplyError 代理服务器回复的失败, 可以使用 errors.Is 与下面的变量比较
+type ReplyError struct {
+	Code byte
+}
+
+var (
+	ErrServerFailure        = &ReplyError{Code: go_socks5.RepServerFailure}
+	ErrRuleFailure          = &ReplyError{Code: go_socks5.RepRuleFailure}
+	ErrNetworkUnreachable   = &ReplyError{Code: go_socks5.RepNetworkUnreachable}
+	ErrHostUnreachable      = &ReplyError{Code: go_socks5.RepHostUnreachable}
+	ErrConnectionRefused    = &ReplyError{Code: go_socks5.RepConnectionRefused}
+	ErrTTLExpired           = &ReplyError{Code: go_socks5.RepTTLExpired}
+	ErrCmdNotSupported      = &ReplyError{Code: go_socks5.RepCmdNotSupported}
+	ErrAddrTypeNotSupported = &ReplyError{Code: go_socks5.RepAddrTypeNotSupported}
+	replyErrors             = []*ReplyError{ErrServerFailure, ErrRuleFailure, ErrNetworkUnreachable, ErrHostUnreachable, ErrConnectionRefused, ErrTTLExpired, ErrCmdNotSupported, ErrAddrTypeNotSupported}
+)
+
+// newReplyError 已知的回复码返回对应的变量
+func newReplyError(code byte) *ReplyError {
+	for _, e := range replyErrors {
+		if e.Code == code {
+			return e
+		}
+	}
+	return &ReplyError{Code: code}
+}
+
+func (e *ReplyError) Error() string {
+	switch e.Code {
+	case go_socks5.RepServerFailure:
+		return "socks5: general server failure"
+	case go_socks5.RepRuleFailure:
+		return "socks5: connection not allowed by ruleset"
+	case go_socks5.RepNetworkUnreachable:
+		return "socks5: network unreachable"
+	case go_socks5.RepHostUnreachable:
+		return "socks5: host unreachable"
+	case go_socks5.RepConnectionRefused:
+		return "socks5: connection refused"
+	case go_socks5.RepTTLExpired:
+		return "socks5: TTL expired"
+	case go_socks5.RepCmdNotSupported:
+		return "socks5: command not supported"
+	case go_socks5.RepAddrTypeNotSupported:
+		return "socks5: address type not supported"
+	default:
+		return fmt.Sprintf("socks5: unknown reply %#x", e.Code)
+	}
+}
+
+// Is 回复码相同的错误相等
+func (e *ReplyError) Is(target error) bool {
+	t, ok := target.(*ReplyError)
+	return ok && t.Code == e.Code
+}
@@ -0,0 +1,448 @@
+package go_socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	DefaultListenAddr       = ":1080"
+	DefaultBufferSize       = 512 * 1024
+	DefaultDialTimeout      = 10 * time.Second
+	DefaultHandshakeTimeout = 30 * time.Second
+	DefaultBindTimeout      = 60 * time.Second
+	DefaultUDPFragTimeout   = 5 * time.Second
+	DefaultUDPFragMaxSize   = 65535
+	DefaultUDPIdleTimeout   = 2 * time.Minute
+	DefaultUDPQueueSize     = 64
+)
+
+var (
+	ErrConfigListenAddr    = errors.New("config: invalid listen address")
+	ErrConfigUDPAddr       = errors.New("config: invalid udp listen address")
+	ErrConfigAdvertiseAddr = errors.New("config: invalid udp advertise address")
+	ErrConfigNetwork       = errors.New("config: listen network must be tcp, tcp4 or tcp6")
+	ErrConfigBufferSize    = errors.New("config: buffer size must not be negative")
+	ErrConfigTimeout       = errors.New("config: timeout must not be negative")
+	ErrConfigUserPass      = errors.New("config: user name and password must be set together")
+	ErrConfigAuth          = errors.New("config: invalid authenticators")
+	ErrConfigBind          = errors.New("config: invalid bind address or port range")
+	ErrConfigUDPFiltering  = errors.New("config: invalid udp filtering mode")
+	ErrConfigUDPSessions   = errors.New("config: udp session limit must not be negative")
+	ErrConfigUDPPort       = errors.New("config: invalid udp port mode or port range")
+	ErrConfigFallback      = errors.New("config: invalid fallback address")
+	ErrConfigTLS           = errors.New("config: tls listener requires certificate and key or TLSConfig")
+)
+
+// Logger 日志输出, *log.Logger 满足该接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// stdLogger 使用标准库log包的默认输出
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	_ = log.Output(2, fmt.Sprintf(format, v...))
+}
+
+func (stdLogger) Println(v ...interface{}) {
+	_ = log.Output(2, fmt.Sprintln(v...))
+}
+
+// UDPFilterMode UDP转发对远程回复的过滤方式 (RFC 4787)
+type UDPFilterMode int
+
+const (
+	// UDPFilterAddressAndPortDependent 只接受发送过的目的地址及端口的回复
+	UDPFilterAddressAndPortDependent UDPFilterMode = iota
+	// UDPFilterAddressDependent 只接受发送过的目的地址的回复, 端口不限
+	UDPFilterAddressDependent
+	// UDPFilterEndpointIndependent 接受任意地址的数据
+	UDPFilterEndpointIndependent
+)
+
+// UDPPortMode UDP ASSOCIATE 转发使用的端口
+type UDPPortMode int
+
+const (
+	// UDPPortShared 所有会话共用UDPListenAddr的端口, 按客户端地址区分会话
+	UDPPortShared UDPPortMode = iota
+	// UDPPortDedicated 每个会话单独监听一个端口, 在BND.ADDR/BND.PORT中回复.
+	// 适用于多个客户端共用同一NAT地址的情况
+	UDPPortDedicated
+)
+
+func (m UDPPortMode) valid() bool {
+	return m == UDPPortShared || m == UDPPortDedicated
+}
+
+// Config 服务配置, 零值字段使用默认值
+type Config struct {
+	// 监听协议族 "tcp"(默认, 双栈), "tcp4" 或 "tcp6", UDP转发使用对应的协议族
+	ListenNetwork string
+	// TCP监听地址, 默认 ":1080"
+	ListenAddr string
+	// UDP转发绑定地址, 默认与ListenAddr相同
+	UDPListenAddr string
+	// UDP ASSOCIATE 回复给客户端的地址, 默认为客户端连接的本地地址加UDP端口. 如果是公网, 配置为公网地址.
+	// UDPAdvertiseAddr6 用于IPv6客户端, 只配置其中一个时所有客户端都使用该地址
+	UDPAdvertiseAddr  string
+	UDPAdvertiseAddr6 string
+
+	// socket缓冲区大小, 默认512KiB
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// tcp keepalive, 周期为0时使用系统默认值
+	DisableKeepAlive bool
+	KeepAlivePeriod  time.Duration
+
+	// 连接远程超时, 默认10s
+	DialTimeout time.Duration
+	// 认证及请求阶段超时, 默认30s
+	HandshakeTimeout time.Duration
+
+	// BIND 监听的IP, 默认为客户端连接的本地地址
+	BindAddr string
+	// BIND 监听的端口范围, 如 "40000-41000", 默认为系统分配的端口
+	BindPortRange string
+	// BIND 等待对端连接的超时, 默认60s
+	BindTimeout time.Duration
+	// BIND 只接受来自请求中DST.ADDR的连接
+	BindCheckPeer bool
+
+	// UDP转发端口方式, 默认 UDPPortShared. UDPUserPortModes 按认证用户名覆盖
+	UDPPortMode      UDPPortMode
+	UDPUserPortModes map[string]UDPPortMode
+	// UDPPortDedicated 监听的端口范围, 如 "50000-51000", 默认为系统分配的端口
+	UDPPortRange string
+
+	// UDP转发对远程回复的过滤方式, 默认 UDPFilterAddressAndPortDependent
+	UDPFiltering UDPFilterMode
+	// UDP回复来自客户端请求的域名解析的地址时, 数据包头使用该域名而不是实际IP
+	UDPEchoDomain bool
+
+	// UDP转发空闲超时, 超时后关闭到远程的socket, 收到数据时重新打开. 默认2分钟, 小于0时不超时
+	UDPIdleTimeout time.Duration
+	// 每个UDP会话待转发的数据包队列长度, 队列满时丢弃, 默认64
+	UDPQueueSize int
+	// UDP目的域名解析缓存时间, 默认1分钟, 小于0时不缓存
+	DNSCacheTTL time.Duration
+	// UDP会话上限, 全局及每个认证用户. 0 不限制
+	MaxUDPSessions        int
+	MaxUDPSessionsPerUser int
+
+	// 不支持UDP分片, 收到FRAG不为0的数据包时丢弃
+	DisableUDPFrag bool
+	// 分片重组超时, 默认5s
+	UDPFragTimeout time.Duration
+	// 每个会话分片重组的最大字节数, 默认65535
+	UDPFragMaxSize int
+	// 客户端使用过分片时, 对超过该大小的回复分片发送. 0 不分片
+	UDPFragReplySize int
+
+	// 不接受SOCKS4/4a请求. SOCKS4没有认证, 只在支持无认证时接受
+	DisableSocks4 bool
+	// 不接受同一端口上的HTTP代理请求
+	DisableHTTP bool
+
+	// SOCKS5 over TLS 监听地址, 为空时不监听. 同一监听上也可以使用SOCKS4及HTTP代理
+	TLSListenAddr string
+	// 服务端证书及私钥文件, 修改后自动重新加载
+	TLSCertFile string
+	TLSKeyFile  string
+	// 客户端证书CA文件, 配置后要求并验证客户端证书(mTLS), 证书的CN或第一个SAN作为认证的用户名
+	TLSClientCAFile string
+	// 客户端证书与SOCKS认证的关系, 默认 TLSIdentityOnly
+	TLSIdentity TLSIdentityMode
+	// 自定义TLS配置, 不为nil时忽略上面的证书文件
+	TLSConfig *tls.Config
+
+	// 端口共用: 按第一个数据识别协议, 不是SOCKS及HTTP代理的连接转发到后端. 都为空时不检测
+	FallbackTLS string // TLS
+	FallbackSSH string // SSH, 以及超时没有发送数据的客户端
+	Fallback    string // 其他无法识别的协议
+	// 等待客户端第一个数据的超时, 默认3s
+	PeekTimeout time.Duration
+
+	// 用户名密码认证, 都为空时不认证. 与Authenticators不能同时配置
+	UserName string
+	Password string
+	// 兼容用户名密码子协商版本号使用0x05的旧客户端
+	AllowLegacyUserPassVersion bool
+
+	// 支持的认证方法, 按服务端优先顺序排列. 为空时根据UserName/Password选择
+	Authenticators []Authenticator
+
+	// 请求过滤, 为nil时允许所有请求
+	Rules RuleSet
+	// 出口地址检查(CONNECT及UDP), 为nil时不检查
+	EgressGuard *EgressGuard
+
+	// 日志, 为nil时使用log包
+	Logger Logger
+
+	udpAdvertise  AddrByte
+	udpAdvertise6 AddrByte
+	bindIP        net.IP
+	bindPorts     portRange
+	udpPorts      portRange
+}
+
+// check 校验配置, 返回填充默认值后的副本
+func (c *Config) check() (*Config, error) {
+	var conf Config
+	if c != nil {
+		conf = *c
+	}
+
+	switch conf.ListenNetwork {
+	case "":
+		conf.ListenNetwork = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrConfigNetwork, conf.ListenNetwork)
+	}
+	tcpNetwork, udpNetwork := conf.networks()
+
+	if conf.ListenAddr == "" {
+		conf.ListenAddr = DefaultListenAddr
+	}
+	if _, err := net.ResolveTCPAddr(tcpNetwork, conf.ListenAddr); err != nil {
+		return nil, fmt.Errorf("%w %v: %v", ErrConfigListenAddr, conf.ListenAddr, err)
+	}
+
+	if conf.UDPListenAddr == "" {
+		conf.UDPListenAddr = conf.ListenAddr
+	}
+	if _, err := net.ResolveUDPAddr(udpNetwork, conf.UDPListenAddr); err != nil {
+		return nil, fmt.Errorf("%w %v: %v", ErrConfigUDPAddr, conf.UDPListenAddr, err)
+	}
+
+	var err error
+	if conf.udpAdvertise, err = parseAdvertiseAddr(conf.UDPAdvertiseAddr); err != nil {
+		return nil, err
+	}
+	if conf.udpAdvertise6, err = parseAdvertiseAddr(conf.UDPAdvertiseAddr6); err != nil {
+		return nil, err
+	}
+
+	if conf.ReadBufferSize < 0 || conf.WriteBufferSize < 0 {
+		return nil, ErrConfigBufferSize
+	}
+	if conf.ReadBufferSize == 0 {
+		conf.ReadBufferSize = DefaultBufferSize
+	}
+	if conf.WriteBufferSize == 0 {
+		conf.WriteBufferSize = DefaultBufferSize
+	}
+
+	if conf.BindAddr != "" {
+		if conf.bindIP = net.ParseIP(conf.BindAddr); conf.bindIP == nil {
+			return nil, fmt.Errorf("%w: %v", ErrConfigBind, conf.BindAddr)
+		}
+	}
+	if conf.BindPortRange != "" {
+		if conf.bindPorts, err = parsePortRange(conf.BindPortRange); err != nil || conf.bindPorts.min == 0 {
+			return nil, fmt.Errorf("%w: %v", ErrConfigBind, conf.BindPortRange)
+		}
+	}
+
+	if conf.UDPFragMaxSize < 0 || conf.UDPFragReplySize < 0 {
+		return nil, ErrConfigBufferSize
+	}
+	if conf.UDPFragMaxSize == 0 {
+		conf.UDPFragMaxSize = DefaultUDPFragMaxSize
+	}
+
+	if !conf.UDPPortMode.valid() {
+		return nil, ErrConfigUDPPort
+	}
+	for user, mode := range conf.UDPUserPortModes {
+		if !mode.valid() {
+			return nil, fmt.Errorf("%w: user %v", ErrConfigUDPPort, user)
+		}
+	}
+	if conf.UDPPortRange != "" {
+		if conf.udpPorts, err = parsePortRange(conf.UDPPortRange); err != nil || conf.udpPorts.min == 0 {
+			return nil, fmt.Errorf("%w: %v", ErrConfigUDPPort, conf.UDPPortRange)
+		}
+	}
+
+	if conf.UDPFiltering < UDPFilterAddressAndPortDependent || conf.UDPFiltering > UDPFilterEndpointIndependent {
+		return nil, ErrConfigUDPFiltering
+	}
+
+	if conf.KeepAlivePeriod < 0 || conf.DialTimeout < 0 || conf.HandshakeTimeout < 0 || conf.BindTimeout < 0 || conf.UDPFragTimeout < 0 {
+		return nil, ErrConfigTimeout
+	}
+	if conf.TLSListenAddr != "" {
+		if _, err := net.ResolveTCPAddr(tcpNetwork, conf.TLSListenAddr); err != nil {
+			return nil, fmt.Errorf("%w %v: %v", ErrConfigListenAddr, conf.TLSListenAddr, err)
+		}
+		if conf.TLSConfig == nil && (conf.TLSCertFile == "" || conf.TLSKeyFile == "") {
+			return nil, ErrConfigTLS
+		}
+	}
+	if conf.TLSIdentity != TLSIdentityOnly && conf.TLSIdentity != TLSIdentityCombine {
+		return nil, fmt.Errorf("%w: identity mode %v", ErrConfigTLS, conf.TLSIdentity)
+	}
+
+	for _, addr := range []string{conf.FallbackTLS, conf.FallbackSSH, conf.Fallback} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("%w %v: %v", ErrConfigFallback, addr, err)
+		}
+	}
+	if conf.PeekTimeout < 0 {
+		return nil, ErrConfigTimeout
+	}
+	if conf.PeekTimeout == 0 {
+		conf.PeekTimeout = DefaultPeekTimeout
+	}
+	if conf.UDPFragTimeout == 0 {
+		conf.UDPFragTimeout = DefaultUDPFragTimeout
+	}
+	if conf.UDPIdleTimeout == 0 {
+		conf.UDPIdleTimeout = DefaultUDPIdleTimeout
+	}
+
+	if conf.UDPQueueSize < 0 {
+		return nil, ErrConfigBufferSize
+	}
+	if conf.UDPQueueSize == 0 {
+		conf.UDPQueueSize = DefaultUDPQueueSize
+	}
+	if conf.DNSCacheTTL == 0 {
+		conf.DNSCacheTTL = DefaultDNSCacheTTL
+	}
+
+	if conf.MaxUDPSessions < 0 || conf.MaxUDPSessionsPerUser < 0 {
+		return nil, ErrConfigUDPSessions
+	}
+	if conf.BindTimeout == 0 {
+		conf.BindTimeout = DefaultBindTimeout
+	}
+	if conf.DialTimeout == 0 {
+		conf.DialTimeout = DefaultDialTimeout
+	}
+	if conf.HandshakeTimeout == 0 {
+		conf.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+
+	if (conf.UserName == "") != (conf.Password == "") {
+		return nil, ErrConfigUserPass
+	}
+	if len(conf.Authenticators) == 0 {
+		if conf.UserName != "" {
+			conf.Authenticators = []Authenticator{UserPassAuthenticator{
+				Credentials:        StaticCredentials{conf.UserName: conf.Password},
+				AllowLegacyVersion: conf.AllowLegacyUserPassVersion,
+			}}
+		} else {
+			conf.Authenticators = []Authenticator{NoAuthAuthenticator{}}
+		}
+	} else {
+		if conf.UserName != "" {
+			return nil, fmt.Errorf("%w: UserName/Password and Authenticators both set", ErrConfigAuth)
+		}
+
+		methods := make(map[MethodType]bool)
+		for _, a := range conf.Authenticators {
+			if a == nil {
+				return nil, fmt.Errorf("%w: nil authenticator", ErrConfigAuth)
+			}
+			if a.Method() == MethodNoAcceptable || methods[a.Method()] {
+				return nil, fmt.Errorf("%w: method %#x", ErrConfigAuth, byte(a.Method()))
+			}
+			methods[a.Method()] = true
+		}
+		conf.Authenticators = append([]Authenticator(nil), conf.Authenticators...)
+	}
+
+	// 不是NewEgressGuard创建的(如 &EgressGuard{}), 使用默认禁止列表, 避免误以为已开启检查
+	if conf.EgressGuard != nil && conf.EgressGuard.deny == nil {
+		guard, err := NewEgressGuard(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		guard.Resolver = conf.EgressGuard.Resolver
+		conf.EgressGuard = guard
+	}
+
+	if conf.Logger == nil {
+		conf.Logger = stdLogger{}
+	}
+
+	// HTTP代理只能使用 CredentialProvider 提供的凭据
+	if !conf.DisableHTTP {
+		for _, a := range conf.Authenticators {
+			if _, ok := a.(CredentialProvider); !ok && a.Method() == MethodUserPass {
+				conf.Logger.Printf("authenticator %T does not implement CredentialProvider, http proxy clients can't authenticate", a)
+			}
+		}
+	}
+
+	return &conf, nil
+}
+
+// networks TCP监听及UDP转发使用的network
+func (c *Config) networks() (tcpNetwork, udpNetwork string) {
+	switch c.ListenNetwork {
+	case "tcp4":
+		return "tcp4", "udp4"
+	case "tcp6":
+		return "tcp6", "udp6"
+	default:
+		return "tcp", "udp"
+	}
+}
+
+// advertiseAddr 配置的UDP ASSOCIATE回复地址, 未配置时返回nil
+func (c *Config) advertiseAddr(isIPv6 bool) AddrByte {
+	if isIPv6 && c.udpAdvertise6 != nil {
+		return c.udpAdvertise6
+	}
+	if c.udpAdvertise != nil {
+		return c.udpAdvertise
+	}
+	return c.udpAdvertise6
+}
+
+// udpPortMode 会话使用的UDP端口方式, 优先使用用户的配置
+func (c *Config) udpPortMode(identity *Identity) UDPPortMode {
+	if identity != nil && identity.User != "" {
+		if mode, ok := c.UDPUserPortModes[identity.User]; ok {
+			return mode
+		}
+	}
+	return c.UDPPortMode
+}
+
+func parseAdvertiseAddr(s string) (AddrByte, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w %v: %v", ErrConfigAdvertiseAddr, s, err)
+	}
+	if host == "" || port == "" || port == "0" {
+		return nil, fmt.Errorf("%w %v: host and port required", ErrConfigAdvertiseAddr, s)
+	}
+
+	addr, err := NewAddrByteFromString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w %v: %v", ErrConfigAdvertiseAddr, s, err)
+	}
+	return addr, nil
+}
@@ -1,52 +1,116 @@
 package go_socks5
 
 import (
-	"fmt"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
-	"log"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
 type connection struct {
-	UserName, Password string
-	conn               *net.TCPConn
-	udpAddr            AddrByte
+	conn     net.Conn
+	udpAddr  AddrByte
+	config   *Config
+	logger   Logger
+	identity *Identity // 认证后的身份
+	version  byte      // 客户端使用的协议版本, 决定回复的格式
+	tlsUser  string    // TLS客户端证书的名称
+
+	httpReader *bufio.Reader // HTTP代理读取请求
+	httpReq    *http.Request // 等待转发的HTTP请求(非CONNECT)
+
+	associations *udpAssociations // udp转发会话, 为nil时不支持UDP ASSOCIATE
+	dns          *dnsCache        // RESOLVE及规则检查使用的解析缓存, 为nil时不缓存
+	dstIPs       []net.IP         // 规则检查时解析的目的地址, 连接时只使用这些地址
+
+	mu     sync.Mutex
+	target io.Closer // 连接的远程或BIND的监听, Close时一起关闭
+	closed bool
 }
 
-func NewConnection(tcpConn *net.TCPConn, udpAddr AddrByte) *connection {
+// newConnection config须为check()返回的配置, 外部使用 Server.ServeConn
+func newConnection(conn net.Conn, udpAddr AddrByte, config *Config) *connection {
 	return &connection{
-		conn:    tcpConn,
+		conn:    conn,
 		udpAddr: udpAddr,
+		config:  config,
+		logger:  config.Logger,
 	}
 }
 
 func (c *connection) Handle() {
 	defer func() {
 		_ = c.conn.Close()
-		log.Printf("close connection. %v %v", c.conn.LocalAddr(), c.conn.RemoteAddr())
+		c.logger.Printf("close connection. %v %v %v", c.conn.LocalAddr(), c.conn.RemoteAddr(), c.identity)
 	}()
 
-	log.Printf("new connection. %v %v", c.conn.LocalAddr(), c.conn.RemoteAddr())
+	c.logger.Printf("new connection. %v %v", c.conn.LocalAddr(), c.conn.RemoteAddr())
 
-	// 认证方法
-	method, err := c.selectAuthMethod()
+	// 认证及请求阶段超时
+	_ = c.conn.SetDeadline(time.Now().Add(c.config.HandshakeTimeout))
+
+	// TLS握手, 验证过的客户端证书作为身份
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if err := c.tlsHandshake(tlsConn); err != nil {
+			c.logger.Printf("tls handshake from %v: %v", c.conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	// 端口共用, 其他协议转发到后端
+	if c.config.demuxEnabled() && !c.demux() {
+		return
+	}
+
+	// 协议版本
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(c.conn, ver); err != nil {
+		c.logger.Println(err)
+		return
+	}
+	c.version = ver[0]
+	r := io.MultiReader(bytes.NewReader(ver), c.conn)
+
+	var req *Request
+	var err error
+	switch {
+	case c.version == SocksVersion:
+		req, err = c.handshake5(r)
+	case c.version == Socks4Version && !c.config.DisableSocks4:
+		req, err = c.handshake4(r)
+	case c.version == Socks4Version:
+		err = ErrSocks4Disabled
+	case isHTTPMethodByte(c.version) && !c.config.DisableHTTP:
+		c.version = httpVersion
+		req, err = c.handshakeHTTP(r)
+	case isHTTPMethodByte(c.version):
+		err = ErrHTTPDisabled
+	default:
+		err = ErrSocksVersion
+	}
 	if err != nil {
-		log.Println(err)
+		c.logger.Println(err)
 		return
 	}
 
-	// 认证
-	if err = c.checkAuthMethod(method); err != nil {
-		log.Println(err)
+	_ = c.conn.SetDeadline(time.Time{})
+
+	// HTTP转发代理, 每个请求单独检查规则及连接
+	if c.httpReq != nil {
+		c.handleHTTPForward()
 		return
 	}
 
-	// 请求建立连接
-	req, err := NewRequestFrom(c.conn)
-	if err != nil {
-		log.Println(err)
+	// 请求过滤
+	if rep := c.allow(req.Cmd, req.AddrByte()); rep != RepSuccess {
+		_ = c.reply(rep, nil)
 		return
 	}
 
@@ -56,28 +120,124 @@ func (c *connection) Handle() {
 	case CmdUdpAssociate: // udp
 		c.handleUDP(req)
 	case CmdBind:
-		_, _ = c.conn.Write(NewReply(RepCmdNotSupported, nil).ToBytes())
+		c.handleBind(req)
+	case CmdResolve:
+		c.handleResolve(req)
+	case CmdResolvePTR:
+		c.handleResolvePTR(req)
 	default:
-		log.Println("error cmd ", req.Cmd)
+		c.logger.Println("error cmd ", req.Cmd)
 		return
 	}
 }
 
+// handshake5 SOCKS5 认证及请求
+func (c *connection) handshake5(r io.Reader) (*Request, error) {
+	// 认证方法
+	auth, err := c.selectAuthMethod(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// 认证
+	if c.identity, err = c.checkAuthMethod(auth); err != nil {
+		return nil, err
+	}
+
+	// 请求建立连接
+	return NewRequestFrom(c.conn)
+}
+
+// reply 按客户端的协议版本回复请求结果. SOCKS4只区分成功与拒绝, HTTP回复对应的状态码
+func (c *connection) reply(rep byte, addr AddrByte) error {
+	var b []byte
+	switch c.version {
+	case Socks4Version:
+		b = NewSocks4Reply(rep == RepSuccess, addr)
+	case httpVersion:
+		b = newHTTPReply(rep)
+	default:
+		b = NewReply(rep, addr).ToBytes()
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// allow 规则检查, 返回回复码, 拒绝时记录匹配的规则.
+// 规则需要目的IP时先解析域名, 解析结果保存在dstIPs中, 之后只连接这些地址
+func (c *connection) allow(cmd byte, dst AddrByte) byte {
+	c.dstIPs = nil
+	if c.config.Rules == nil {
+		return RepSuccess
+	}
+
+	r := NewRuleRequest(c.conn.RemoteAddr(), c.identity, cmd, dst)
+	if r.Host != "" && needIP(c.config.Rules) {
+		ips, err := c.lookup(r.Host)
+		if err != nil || len(ips) == 0 {
+			c.logger.Printf("resolve %v: %v", r.Host, err)
+			return RepHostUnreachable
+		}
+		c.dstIPs = ips
+	}
+
+	allow, rule := allowResolved(c.config.Rules, r, c.dstIPs)
+	if !allow {
+		c.logger.Printf("request %v denied by rule %v", r, rule)
+		return RepRuleFailure
+	}
+	return RepSuccess
+}
+
+// lookup 使用会话共享的缓存解析域名
+func (c *connection) lookup(host string) ([]net.IP, error) {
+	dns := c.dns
+	if dns == nil {
+		dns = newConfigDNSCache(c.config)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.DialTimeout)
+	defer cancel()
+
+	return dns.lookup(ctx, host)
+}
+
+// Close 关闭客户端连接及远程连接, 用于强制结束会话
+func (c *connection) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	_ = c.conn.Close()
+	if c.target != nil {
+		_ = c.target.Close()
+	}
+}
+
+// setTarget 记录远程连接, 会话已关闭时返回false
+func (c *connection) setTarget(conn io.Closer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.target = conn
+	return true
+}
+
 func (c *connection) handleTCP(req *Request) {
-	targetAddr := req.Address()
+	host, port := req.AddrByte().HostPort()
 
-	targetConn, err := net.Dial("tcp", targetAddr)
+	targetConn, err := dialTarget(c.config, "tcp", host, c.dstIPs, port)
 	if err != nil {
-		msg := err.Error()
-		var rep byte = RepHostUnreachable
-		if strings.Contains(msg, "refused") {
-			rep = RepConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			rep = RepNetworkUnreachable
+		rep := dialErrorReply(err)
+		if rep == RepRuleFailure {
+			c.logger.Println(err)
 		}
 
-		_, _ = c.conn.Write(NewReply(rep, nil).ToBytes())
-		log.Printf("connect to %v failed", req.Address())
+		_ = c.reply(rep, nil)
+		c.logger.Printf("connect to %v failed", req.Address())
 		return
 	}
 
@@ -85,45 +245,115 @@ func (c *connection) handleTCP(req *Request) {
 		_ = targetConn.Close()
 	}()
 
+	if !c.setTarget(targetConn) {
+		return
+	}
+
 	// 本地地址
 	bAddr, err := NewAddrByteFromString(targetConn.LocalAddr().(*net.TCPAddr).String())
 	if err != nil {
-		_, _ = c.conn.Write(NewReply(RepServerFailure, nil).ToBytes())
+		_ = c.reply(RepServerFailure, nil)
 
-		log.Println(err)
+		c.logger.Println(err)
 		return
 	}
 
-	if _, err = c.conn.Write(NewReply(RepSuccess, bAddr).ToBytes()); err != nil {
-		log.Println(err)
+	if err = c.reply(RepSuccess, bAddr); err != nil {
+		c.logger.Println(err)
 		return
 	}
 
+	c.relay(targetConn)
+}
+
+// dialErrorReply 连接失败对应的回复码
+func dialErrorReply(err error) byte {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, ErrEgressDenied):
+		return RepRuleFailure
+	case strings.Contains(msg, "refused"):
+		return RepConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return RepNetworkUnreachable
+	default:
+		return RepHostUnreachable
+	}
+}
+
+// relay 在客户端和远程之间转发数据, 直到两个方向都结束
+func (c *connection) relay(targetConn net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
 
-		_, _ = io.Copy(c.conn, targetConn)
+		_, err := io.Copy(c.conn, targetConn)
+		relayDone(c.conn, targetConn, err)
 	}()
 
 	go func() {
 		defer wg.Done()
 
-		_, _ = io.Copy(targetConn, c.conn)
+		_, err := io.Copy(targetConn, c.conn)
+		relayDone(targetConn, c.conn, err)
 	}()
 
 	wg.Wait()
 }
 
+// relayDone 一个方向转发结束, 正常结束时半关闭dst的写方向, 出错时关闭两端使另一个方向也结束
+func relayDone(dst, src net.Conn, err error) {
+	if err != nil {
+		_ = dst.Close()
+		_ = src.Close()
+		return
+	}
+	_ = closeWrite(dst)
+}
+
+// closeWrite 半关闭写方向, 不支持半关闭时关闭连接
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// handleUDP 注册UDP会话, 只接受来自控制连接客户端IP(及请求中DST.PORT)的数据, 控制连接关闭时结束会话
 func (c *connection) handleUDP(req *Request) {
-	_ = req.Address()
-	if _, err := c.conn.Write(NewReply(RepSuccess, c.udpAddr).ToBytes()); err != nil {
-		log.Println(err)
+	clientIP := addrIP(c.conn.RemoteAddr())
+	dedicated := c.config.udpPortMode(c.identity) == UDPPortDedicated
+	if (c.udpAddr == nil && !dedicated) || c.associations == nil || clientIP == nil {
+		_ = c.reply(RepCmdNotSupported, nil)
+		return
+	}
+
+	assoc := newUDPAssociation(c.identity, clientIP, req.AddrByte())
+	assoc.dedicated = dedicated
+	if err := c.associations.add(assoc); err != nil {
+		_ = c.reply(RepServerFailure, nil)
+		c.logger.Printf("udp associate from %v(%v): %v", c.conn.RemoteAddr(), c.identity, err)
 		return
 	}
+	defer c.associations.remove(assoc)
 
+	if dedicated {
+		c.handleUDPDedicated(assoc)
+		return
+	}
+
+	if err := c.reply(RepSuccess, c.udpAddr); err != nil {
+		c.logger.Println(err)
+		return
+	}
+
+	c.waitClose()
+}
+
+// waitClose 读取控制连接直到关闭
+func (c *connection) waitClose() {
 	buffer := make([]byte, 128)
 	for {
 		_, err := c.conn.Read(buffer)
@@ -133,74 +363,60 @@ func (c *connection) handleUDP(req *Request) {
 	}
 }
 
-func (c *connection) selectAuthMethod() (MethodType, error) {
-	req, err := NewMethodSelectReqFrom(c.conn)
+// selectAuthMethod 按服务端配置的顺序选择客户端支持的第一个认证方法
+func (c *connection) selectAuthMethod(r io.Reader) (Authenticator, error) {
+	req, err := NewMethodSelectReqFrom(r)
 	if err != nil {
-		return MethodNoAcceptable, err
+		return nil, err
 	}
 
 	if req.Ver != SocksVersion {
-		return MethodNoAcceptable, ErrSocksVersion
+		return nil, ErrSocksVersion
 	}
 
-	var method = MethodNoAuth
-	if c.UserName != "" && c.Password != "" {
-		method = MethodUserPass
+	// 客户端证书可以替代认证时优先无认证
+	auths := c.config.Authenticators
+	if c.certOnly() {
+		auths = append([]Authenticator{NoAuthAuthenticator{}}, auths...)
 	}
 
-	var exist bool
-	for _, v := range req.Methods {
-		if byte(method) == v {
-			exist = true
+	var auth Authenticator
+	for _, a := range auths {
+		for _, v := range req.Methods {
+			if byte(a.Method()) == v {
+				auth = a
+				break
+			}
+		}
+		if auth != nil {
 			break
 		}
 	}
 
-	if !exist {
-		method = MethodNoAcceptable
+	var method = MethodNoAcceptable
+	if auth != nil {
+		method = auth.Method()
 	}
 
 	res := NewMethodSelectReply(method)
 	if _, err := c.conn.Write(res.ToBytes()); err != nil {
-		return MethodNoAcceptable, err
+		return nil, err
 	}
 
-	if method == MethodNoAcceptable {
-		return MethodNoAcceptable, ErrMethodNoAcceptable
+	if auth == nil {
+		return nil, ErrMethodNoAcceptable
 	}
 
-	return method, nil
+	return auth, nil
 }
 
-func (c *connection) checkAuthMethod(method MethodType) error {
-	switch method {
-	case MethodNoAuth:
-		return nil
-	case MethodUserPass:
-		req, err := NewUserPassAuthReqFrom(c.conn)
-		if err != nil {
-			return fmt.Errorf("NewUserPassAuthReqFrom:%w", err)
-		}
-
-		if req.Ver != SocksVersion {
-			return ErrAuthUserPassVer
-		}
-
-		var status byte = AuthStatusFailure
-		if string(req.UserName) == c.UserName && string(req.Password) == c.Password {
-			status = AuthStatusSuccess
-		}
-
-		_, err = c.conn.Write(NewUserPassAuthReply(status).ToBytes())
-		if err != nil {
-			return fmt.Errorf("reply:%w", err)
-		}
-
-		if status != AuthStatusSuccess {
-			return ErrAuthFailed
-		}
-		return nil
-	default:
-		return ErrMethod
+func (c *connection) checkAuthMethod(auth Authenticator) (*Identity, error) {
+	identity, err := auth.Authenticate(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil {
+		identity = &Identity{Method: auth.Method()}
 	}
+	return c.bindTLSIdentity(identity)
 }
@@ -13,6 +13,10 @@ const (
 	CmdConnect      byte = 0x01
 	CmdBind         byte = 0x02
 	CmdUdpAssociate byte = 0x03
+
+	// Tor扩展, 在代理端解析域名, 不建立连接
+	CmdResolve    byte = 0xF0
+	CmdResolvePTR byte = 0xF1
 )
 
 type MethodType byte
@@ -29,6 +33,12 @@ const (
 	ATypIPv6   byte = 0x04
 )
 
+// UserPassAuthVersion RFC 1929 用户名密码子协商版本
+const (
+	UserPassAuthVersion       byte = 0x01
+	UserPassAuthLegacyVersion byte = 0x05 // 部分旧客户端错误地使用socks版本号
+)
+
 const (
 	AuthStatusSuccess = 0x00
 	AuthStatusFailure = 0x01
@@ -52,10 +62,12 @@ var (
 	NoSupportedAuth       = errors.New("no supported auth")
 	ErrAuthUserPassVer    = errors.New("auth user pass version")
 	ErrCmdNotSupport      = errors.New("cmd not support")
+	ErrRuleDenied         = errors.New("denied by rule")
+	ErrUDPSessionLimit    = errors.New("too many udp sessions")
 
 	ErrAddrType     = fmt.Errorf("unrecognized address type")
 	ErrSocksVersion = fmt.Errorf("not socks version 5")
 	ErrMethod       = fmt.Errorf("unsupport method")
 	ErrBadRequest   = fmt.Errorf("bad request")
-	ErrUDPFrag      = fmt.Errorf("frag !=0 not supported")
+	ErrUDPFrag      = fmt.Errorf("udp fragment not accepted")
 )
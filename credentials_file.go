@@ -0,0 +1,287 @@
+package go_socks5
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultCredentialsReloadInterval 检查凭据文件修改的间隔
+const DefaultCredentialsReloadInterval = 5 * time.Second
+
+var ErrCredentialsFormat = errors.New("credentials: bad file format")
+
+// dummyHash 用户不存在时参与比较, 避免通过响应时间枚举用户名
+const dummyHash = "$2a$10$STAMsO74CvucrQZjik2F7ufcfqFHQb4lS72c4WWGhsdBw2CxuIKhm"
+
+// FileCredentials 文件中的用户名密码, 文件修改后自动重新加载, 已认证的会话不受影响.
+//
+// 扩展名为 .json 时格式为 {"user": "password"}, 否则为htpasswd格式, 每行 user:password.
+// password 可以是 bcrypt($2a$, $2b$, $2y$), argon2($argon2id$, $argon2i$), {SHA} 或明文.
+// 其他以 $ 或 { 开头的格式(如 $apr1$, {SSHA})及参数超出范围的argon2, 加载时返回 ErrCredentialsFormat
+type FileCredentials struct {
+	path   string
+	logger Logger
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// NewFileCredentials 加载path, 每interval检查一次文件是否修改. interval为0时使用默认值, 小于0时不自动重新加载
+func NewFileCredentials(path string, interval time.Duration, logger Logger) (*FileCredentials, error) {
+	if logger == nil {
+		logger = stdLogger{}
+	}
+
+	f := &FileCredentials{
+		path:    path,
+		logger:  logger,
+		closeCh: make(chan struct{}),
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	if interval == 0 {
+		interval = DefaultCredentialsReloadInterval
+	}
+	if interval > 0 {
+		go f.watch(interval)
+	}
+
+	return f, nil
+}
+
+// Valid 校验用户名密码
+func (f *FileCredentials) Valid(user, password string) bool {
+	f.mu.RLock()
+	hash, ok := f.users[user]
+	f.mu.RUnlock()
+
+	if !ok {
+		_ = checkPassword(dummyHash, password)
+		return false
+	}
+	return checkPassword(hash, password)
+}
+
+// Reload 重新加载文件, 失败时保留原来的用户
+func (f *FileCredentials) Reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var users map[string]string
+	if strings.EqualFold(filepath.Ext(f.path), ".json") {
+		users, err = parseJSONCredentials(data)
+	} else {
+		users, err = parseHtpasswd(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %w", f.path, err)
+	}
+
+	f.mu.Lock()
+	f.users = users
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.mu.Unlock()
+	return nil
+}
+
+// Close 停止自动重新加载
+func (f *FileCredentials) Close() {
+	f.closeOnce.Do(func() {
+		close(f.closeCh)
+	})
+}
+
+func (f *FileCredentials) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(f.path)
+		if err != nil {
+			f.logger.Printf("credentials %v: %v", f.path, err)
+			continue
+		}
+
+		f.mu.RLock()
+		changed := !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+		f.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err = f.Reload(); err != nil {
+			f.logger.Printf("reload credentials: %v", err)
+			continue
+		}
+		f.logger.Printf("reload credentials %v", f.path)
+	}
+}
+
+func parseJSONCredentials(data []byte) (map[string]string, error) {
+	var users map[string]string
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCredentialsFormat, err)
+	}
+	for user, hash := range users {
+		if user == "" {
+			return nil, fmt.Errorf("%w: empty user name", ErrCredentialsFormat)
+		}
+		if !supportedHash(hash) {
+			return nil, fmt.Errorf("%w: unsupported or invalid password format for %v", ErrCredentialsFormat, user)
+		}
+	}
+	return users, nil
+}
+
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%w: line %d", ErrCredentialsFormat, line)
+		}
+		if !supportedHash(text[i+1:]) {
+			return nil, fmt.Errorf("%w: line %d: unsupported or invalid password format", ErrCredentialsFormat, line)
+		}
+		users[text[:i]] = text[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// supportedHash 是否为checkPassword支持的格式, 未知的哈希格式不能当作明文比较. argon2同时检查参数范围
+func supportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return true
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		_, err := parseArgon2(hash)
+		return err == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	default:
+		return !strings.HasPrefix(hash, "$") && !strings.HasPrefix(hash, "{")
+	}
+}
+
+// checkPassword 按hash的格式校验密码
+func checkPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2"):
+		return checkArgon2(hash, password)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return secureCompare(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		return secureCompare(hash, password)
+	}
+}
+
+// argon2MaxMemory argon2的内存参数上限(KiB), 避免每次认证分配过多内存
+const argon2MaxMemory = 256 * 1024
+
+// argon2Hash 解析后的argon2哈希
+type argon2Hash struct {
+	variant    string
+	memory     uint32
+	iterations uint32
+	threads    uint8
+	salt       []byte
+	key        []byte
+}
+
+// parseArgon2 PHC格式 $argon2id$v=19$m=65536,t=3,p=4$salt$hash, 检查参数范围
+func parseArgon2(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+		return nil, fmt.Errorf("%w: bad argon2 hash", ErrCredentialsFormat)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("%w: unsupported argon2 version %v", ErrCredentialsFormat, parts[2])
+	}
+
+	h := &argon2Hash{variant: parts[1]}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.threads); err != nil {
+		return nil, fmt.Errorf("%w: bad argon2 parameters %v", ErrCredentialsFormat, parts[3])
+	}
+	if h.memory == 0 || h.memory > argon2MaxMemory || h.iterations < 1 || h.threads < 1 {
+		return nil, fmt.Errorf("%w: argon2 parameters out of range %v", ErrCredentialsFormat, parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("%w: bad argon2 salt", ErrCredentialsFormat)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, fmt.Errorf("%w: bad argon2 key", ErrCredentialsFormat)
+	}
+	return h, nil
+}
+
+// checkArgon2 参数不合法时返回false, 不调用argon2
+func checkArgon2(hash, password string) bool {
+	h, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+
+	var derived []byte
+	switch h.variant {
+	case "argon2id":
+		derived = argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+	default:
+		derived = argon2.Key([]byte(password), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(derived, h.key) == 1
+}
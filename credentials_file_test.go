@@ -0,0 +1,123 @@
+package go_socks5
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func argon2idHash(password string, memory, iterations uint32, threads uint8) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, iterations, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{name: "plain", line: "alice:secret"},
+		{name: "sha", line: "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+		{name: "bcrypt", line: "alice:" + dummyHash},
+		{name: "argon2id", line: "alice:" + argon2idHash("secret", 64, 1, 1)},
+		{name: "apr1", line: "alice:$apr1$salt$hash", wantErr: true},
+		{name: "sha512 crypt", line: "alice:$6$salt$hash", wantErr: true},
+		{name: "ssha", line: "alice:{SSHA}hash", wantErr: true},
+		{name: "argon2 zero parallelism", line: "bob:$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key, wantErr: true},
+		{name: "argon2 zero iterations", line: "bob:$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "argon2 zero memory", line: "bob:$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "argon2 huge memory", line: "bob:$argon2id$v=19$m=4194304,t=1,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "argon2 parallelism overflow", line: "bob:$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key, wantErr: true},
+		{name: "argon2 bad version", line: "bob:$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "argon2d", line: "bob:$argon2d$v=19$m=64,t=1,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "missing separator", line: "alice", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := parseHtpasswd([]byte(tt.line + "\n"))
+		if tt.wantErr {
+			if !errors.Is(err, ErrCredentialsFormat) {
+				t.Errorf("%v: err = %v, want ErrCredentialsFormat", tt.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error %v", tt.name, err)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("secret"))
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{name: "plain", hash: "secret", want: true},
+		{name: "plain wrong", hash: "other"},
+		{name: "bcrypt", hash: string(bcryptHash), want: true},
+		{name: "sha", hash: "{SHA}" + base64.StdEncoding.EncodeToString(sum[:]), want: true},
+		{name: "argon2id", hash: argon2idHash("secret", 64, 1, 1), want: true},
+		{name: "argon2id wrong", hash: argon2idHash("other", 64, 1, 1)},
+		// 参数不合法时不能调用argon2, 否则panic
+		{name: "argon2 zero parallelism", hash: "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5"},
+		{name: "argon2 zero iterations", hash: "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+	}
+
+	for _, tt := range tests {
+		if got := checkPassword(tt.hash, "secret"); got != tt.want {
+			t.Errorf("%v: checkPassword = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, _ = f.WriteString("alice:" + argon2idHash("secret", 64, 1, 1) + "\n")
+	_ = f.Close()
+
+	creds, err := NewFileCredentials(f.Name(), -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !creds.Valid("alice", "secret") || creds.Valid("alice", "other") || creds.Valid("bob", "secret") {
+		t.Error("unexpected Valid result")
+	}
+
+	// 参数不合法的文件加载失败, 保留原来的用户
+	if err = ioutil.WriteFile(f.Name(), []byte("bob:$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = creds.Reload(); !errors.Is(err, ErrCredentialsFormat) {
+		t.Errorf("Reload err = %v, want ErrCredentialsFormat", err)
+	}
+	if !creds.Valid("alice", "secret") || creds.Valid("bob", "secret") {
+		t.Error("users changed after failed reload")
+	}
+
+	if _, err = NewFileCredentials(f.Name(), -1, nil); !errors.Is(err, ErrCredentialsFormat) {
+		t.Errorf("NewFileCredentials err = %v, want ErrCredentialsFormat", err)
+	}
+}
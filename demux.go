@@ -0,0 +1,138 @@
+package go_socks5
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+)
+
+const DefaultPeekTimeout = 3 * time.Second
+
+// protocolKind 连接第一个数据识别的协议
+type protocolKind int
+
+const (
+	protocolUnknown protocolKind = iota
+	protocolSocks
+	protocolHTTP
+	protocolTLS
+	protocolSSH
+	protocolSilent // 超时没有发送数据, 如等待服务端先发送banner的SSH客户端
+)
+
+func (k protocolKind) String() string {
+	switch k {
+	case protocolSocks:
+		return "socks"
+	case protocolHTTP:
+		return "http"
+	case protocolTLS:
+		return "tls"
+	case protocolSSH:
+		return "ssh"
+	case protocolSilent:
+		return "silent"
+	default:
+		return "unknown"
+	}
+}
+
+var sshPrefix = []byte("SSH-")
+
+// classifyProtocol 按第一个字节识别协议, 'S' 开头时需要前4个字节区分SSH
+func classifyProtocol(b []byte, config *Config) protocolKind {
+	if len(b) == 0 {
+		return protocolSilent
+	}
+
+	switch {
+	case b[0] == SocksVersion:
+		return protocolSocks
+	case b[0] == Socks4Version && !config.DisableSocks4:
+		return protocolSocks
+	case b[0] == 0x16: // TLS handshake record
+		return protocolTLS
+	case bytes.HasPrefix(b, sshPrefix):
+		return protocolSSH
+	case isHTTPMethodByte(b[0]) && !config.DisableHTTP:
+		return protocolHTTP
+	default:
+		return protocolUnknown
+	}
+}
+
+// fallbackAddr 协议对应的后端地址, 为空时由本服务处理或关闭
+func (c *Config) fallbackAddr(kind protocolKind) string {
+	switch kind {
+	case protocolTLS:
+		return c.FallbackTLS
+	case protocolSSH:
+		return c.FallbackSSH
+	case protocolSilent:
+		if c.FallbackSSH != "" {
+			return c.FallbackSSH
+		}
+		return c.Fallback
+	case protocolUnknown:
+		return c.Fallback
+	default:
+		return ""
+	}
+}
+
+// demuxEnabled 配置了任一后端时检测协议
+func (c *Config) demuxEnabled() bool {
+	return c.FallbackTLS != "" || c.FallbackSSH != "" || c.Fallback != ""
+}
+
+// demux 读取连接的第一个数据识别协议, 非SOCKS及HTTP代理的连接转发到配置的后端.
+// 返回false时连接已处理完
+func (c *connection) demux() bool {
+	br := bufio.NewReader(c.conn)
+	c.mu.Lock()
+	c.conn = &bufferedConn{Conn: c.conn, r: br}
+	c.mu.Unlock()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.config.PeekTimeout))
+	b, err := br.Peek(1)
+	if err == nil && b[0] == sshPrefix[0] {
+		b, err = br.Peek(len(sshPrefix))
+	}
+	if err != nil && len(b) == 0 {
+		// 超时按没有发送数据处理, 其他错误为连接已关闭
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return false
+		}
+	}
+
+	kind := classifyProtocol(b, c.config)
+	if kind == protocolSocks || kind == protocolHTTP {
+		_ = c.conn.SetDeadline(time.Now().Add(c.config.HandshakeTimeout))
+		return true
+	}
+
+	backend := c.config.fallbackAddr(kind)
+	if backend == "" {
+		c.logger.Printf("demux %v from %v: no backend", kind, c.conn.RemoteAddr())
+		return false
+	}
+	_ = c.conn.SetDeadline(time.Time{})
+
+	backendConn, err := net.DialTimeout("tcp", backend, c.config.DialTimeout)
+	if err != nil {
+		c.logger.Printf("demux %v from %v to %v: %v", kind, c.conn.RemoteAddr(), backend, err)
+		return false
+	}
+	defer func() {
+		_ = backendConn.Close()
+	}()
+
+	if !c.setTarget(backendConn) {
+		return false
+	}
+
+	c.logger.Printf("demux %v from %v to %v", kind, c.conn.RemoteAddr(), backend)
+	c.relay(backendConn)
+	return false
+}
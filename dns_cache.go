@@ -0,0 +1,116 @@
+package go_socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDNSCacheTTL  = time.Minute
+	DefaultDNSCacheSize = 4096
+)
+
+// dnsCache 域名解析缓存, 相同域名同时只解析一次
+type dnsCache struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+	size     int
+
+	mu       sync.Mutex
+	entries  map[string]*dnsEntry
+	inflight map[string]*dnsCall
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+type dnsCall struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+func newDNSCache(resolver *net.Resolver, ttl time.Duration, size int) *dnsCache {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &dnsCache{
+		resolver: resolver,
+		ttl:      ttl,
+		size:     size,
+		entries:  make(map[string]*dnsEntry),
+		inflight: make(map[string]*dnsCall),
+	}
+}
+
+// newConfigDNSCache 配置了EgressGuard时使用其Resolver
+func newConfigDNSCache(config *Config) *dnsCache {
+	var resolver *net.Resolver
+	if config.EgressGuard != nil {
+		resolver = config.EgressGuard.Resolver
+	}
+	return newDNSCache(resolver, config.DNSCacheTTL, DefaultDNSCacheSize)
+}
+
+// lookup 解析host, IP直接返回. ttl小于0时不缓存
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	now := time.Now()
+
+	d.mu.Lock()
+	if e, ok := d.entries[host]; ok && now.Before(e.expires) {
+		d.mu.Unlock()
+		return e.ips, nil
+	}
+	if call, ok := d.inflight[host]; ok {
+		d.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.ips, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call := &dnsCall{done: make(chan struct{})}
+	d.inflight[host] = call
+	d.mu.Unlock()
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	for _, addr := range addrs {
+		call.ips = append(call.ips, addr.IP)
+	}
+	call.err = err
+
+	d.mu.Lock()
+	delete(d.inflight, host)
+	if err == nil && d.ttl > 0 {
+		if len(d.entries) >= d.size {
+			d.evictLocked(now)
+		}
+		d.entries[host] = &dnsEntry{ips: call.ips, expires: now.Add(d.ttl)}
+	}
+	d.mu.Unlock()
+	close(call.done)
+
+	return call.ips, call.err
+}
+
+// evictLocked 删除过期的记录, 仍然超过上限时清空
+func (d *dnsCache) evictLocked(now time.Time) {
+	for host, e := range d.entries {
+		if !now.Before(e.expires) {
+			delete(d.entries, host)
+		}
+	}
+	if len(d.entries) >= d.size {
+		d.entries = make(map[string]*dnsEntry)
+	}
+}
@@ -0,0 +1,159 @@
+package go_socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+var ErrEgressDenied = errors.New("egress: destination address denied")
+
+// DefaultEgressDeny 默认禁止连接的地址: 回环、私有、链路本地、组播及未指定地址
+var DefaultEgressDeny = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// EgressGuard 出口地址检查. 域名先解析, 所有解析结果都允许时才连接, 并且连接检查过的IP, 避免DNS rebinding.
+// 使用 NewEgressGuard 创建, Config中的零值等同于 NewEgressGuard(nil, nil)
+type EgressGuard struct {
+	deny  []*net.IPNet
+	allow []*net.IPNet
+	self  []net.IP // 代理自身的地址
+
+	// 为nil时使用 net.DefaultResolver
+	Resolver *net.Resolver
+}
+
+// NewEgressGuard deny为空时使用 DefaultEgressDeny, 代理自身的地址也被禁止. allow中的地址不受限制
+func NewEgressGuard(deny []string, allow []string) (*EgressGuard, error) {
+	if len(deny) == 0 {
+		deny = DefaultEgressDeny
+	}
+
+	g := &EgressGuard{}
+
+	var err error
+	if g.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	if g.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			g.self = append(g.self, ipNet.IP)
+		}
+	}
+
+	return g, nil
+}
+
+// Check 检查一个IP是否允许连接
+func (g *EgressGuard) Check(ip net.IP) error {
+	if matchCIDRs(g.allow, ip) {
+		return nil
+	}
+
+	for _, self := range g.self {
+		if self.Equal(ip) {
+			return fmt.Errorf("%w: %v is proxy address", ErrEgressDenied, ip)
+		}
+	}
+
+	if matchCIDRs(g.deny, ip) {
+		return fmt.Errorf("%w: %v", ErrEgressDenied, ip)
+	}
+	return nil
+}
+
+// Resolve 解析host并检查所有地址, 任一地址被禁止时返回错误
+func (g *EgressGuard) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolver := g.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	if err := g.CheckAll(host, ips); err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// CheckAll 检查host解析得到的所有地址
+func (g *EgressGuard) CheckAll(host string, ips []net.IP) error {
+	for _, ip := range ips {
+		if err := g.Check(ip); err != nil {
+			return fmt.Errorf("%v: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// dialTarget 连接目的地址. ips为规则检查时解析的地址, 不为空时只连接这些地址.
+// 配置了EgressGuard时先解析检查, 再依次连接检查过的IP
+func dialTarget(config *Config, network string, host string, ips []net.IP, port int) (net.Conn, error) {
+	if config.EgressGuard == nil && len(ips) == 0 {
+		return net.DialTimeout(network, net.JoinHostPort(host, strconv.Itoa(port)), config.DialTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DialTimeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case len(ips) == 0:
+		ips, err = config.EgressGuard.Resolve(ctx, host)
+	case config.EgressGuard != nil:
+		err = config.EgressGuard.CheckAll(host, ips)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%v: no address", host)
+	}
+	return nil, lastErr
+}
@@ -6,7 +6,7 @@ import (
 	"net/url"
 	"time"
 
-	"golang.org/x/net/proxy"
+	"github.com/general252/go_socks5/client"
 )
 
 func init() {
@@ -20,7 +20,7 @@ func main() {
 		log.Panicln(err)
 	}
 
-	pxy, err := proxy.FromURL(targetURL, nil)
+	pxy, err := client.FromURL(targetURL)
 	if err != nil {
 		log.Panicln(err)
 	}
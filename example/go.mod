@@ -4,7 +4,7 @@ go 1.14
 
 require (
 	github.com/general252/go_socks5 v0.0.1
-	golang.org/x/net v0.0.0-20220325170049-de3da57026de
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 )
 
 replace github.com/general252/go_socks5 v0.0.1 => ../
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/general252/go_socks5"
 )
@@ -14,14 +16,26 @@ func init() {
 }
 
 func main() {
-	s := go_socks5.NewServer()
-	if err := s.Start(1080); err != nil {
-		log.Println(err)
+	s, err := go_socks5.NewServer(&go_socks5.Config{
+		ListenAddr: ":1080",
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	if err = s.Start(); err != nil {
+		log.Panicln(err)
 	}
 
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Kill, syscall.SIGINT, syscall.SIGTERM)
 	<-c
 
-	s.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err = s.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	<-s.Done()
 }
@@ -1,3 +1,5 @@
 module github.com/general252/go_socks5
 
 go 1.14
+
+require golang.org/x/crypto v0.0.0-20220214200702-86341886e292
@@ -0,0 +1,290 @@
+package go_socks5
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpVersion HTTP代理请求的协议版本标记, 不与SOCKS版本号冲突
+const httpVersion byte = 'H'
+
+var (
+	ErrHTTPDisabled = errors.New("http proxy disabled")
+	ErrHTTPAuth     = errors.New("http proxy authentication failed")
+	ErrHTTPRequest  = errors.New("http proxy request must use absolute http url")
+)
+
+// isHTTPMethodByte 请求行的第一个字符, HTTP方法都是大写字母
+func isHTTPMethodByte(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// bufferedConn 读取时先返回已缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite 半关闭底层连接的写方向
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// handshakeHTTP 读取HTTP代理请求并认证, CONNECT转换为SOCKS5 CONNECT请求, 其他请求等待转发
+func (c *connection) handshakeHTTP(r io.Reader) (*Request, error) {
+	br := bufio.NewReader(r)
+	httpReq, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	// 请求之后已缓冲的数据在转发时发送
+	c.mu.Lock()
+	c.conn = &bufferedConn{Conn: c.conn, r: br}
+	c.mu.Unlock()
+	c.httpReader = br
+
+	if c.identity, err = c.httpAuthenticate(httpReq); err != nil {
+		c.writeHTTPStatus(http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"proxy\"\r\n")
+		return nil, err
+	}
+
+	// 其他方法由 handleHTTPForward 转发
+	if httpReq.Method != http.MethodConnect {
+		c.httpReq = httpReq
+		return nil, nil
+	}
+
+	addr, err := httpTargetAddr(httpReq.Host, 443)
+	if err != nil {
+		c.writeHTTPStatus(http.StatusBadRequest, "")
+		return nil, err
+	}
+
+	c.logger.Printf("http %v %v from %v(%v)", httpReq.Method, addr, c.conn.RemoteAddr(), c.identity)
+	return NewRequest(CmdConnect, addr), nil
+}
+
+// httpAuthenticate Proxy-Authorization: Basic 使用 CredentialProvider 的用户名密码认证. 支持无认证或客户端证书认证时可以不带认证信息
+func (c *connection) httpAuthenticate(req *http.Request) (*Identity, error) {
+	var credentials CredentialStore
+	var noAuth bool
+	for _, a := range c.config.Authenticators {
+		switch a.Method() {
+		case MethodNoAuth:
+			noAuth = true
+		case MethodUserPass:
+			if p, ok := a.(CredentialProvider); ok && credentials == nil {
+				credentials = p.CredentialStore()
+			}
+		}
+	}
+
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" || credentials == nil {
+		if noAuth || c.certOnly() {
+			return c.bindTLSIdentity(&Identity{Method: MethodNoAuth})
+		}
+		return nil, ErrHTTPAuth
+	}
+
+	user, password, ok := parseBasicAuth(header)
+	if !ok || !credentials.Valid(user, password) {
+		return nil, fmt.Errorf("%w: user %q", ErrHTTPAuth, user)
+	}
+	return c.bindTLSIdentity(&Identity{Method: MethodUserPass, User: user})
+}
+
+// hopHeaders 逐跳头部, 不转发 (RFC 7230 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders 删除逐跳头部及Connection中列出的头部
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// handleHTTPForward 转发绝对URI形式的HTTP请求, 支持keep-alive.
+// 每个请求按CONNECT检查规则, 目的地址不变时复用到远程的连接
+func (c *connection) handleHTTPForward() {
+	var (
+		target     net.Conn
+		targetAddr string
+		targetR    *bufio.Reader
+	)
+	defer func() {
+		if target != nil {
+			_ = target.Close()
+		}
+	}()
+
+	req := c.httpReq
+	for {
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			c.writeHTTPStatus(http.StatusBadRequest, "")
+			c.logger.Printf("%v: %v", ErrHTTPRequest, req.URL)
+			return
+		}
+
+		addr, err := httpTargetAddr(req.URL.Host, 80)
+		if err != nil {
+			c.writeHTTPStatus(http.StatusBadRequest, "")
+			c.logger.Println(err)
+			return
+		}
+
+		c.logger.Printf("http %v %v from %v(%v)", req.Method, req.URL, c.conn.RemoteAddr(), c.identity)
+
+		if rep := c.allow(CmdConnect, addr); rep != RepSuccess {
+			_ = c.reply(rep, nil)
+			return
+		}
+
+		if target != nil && targetAddr != addr.String() {
+			_ = target.Close()
+			target = nil
+		}
+		if target == nil {
+			host, port := addr.HostPort()
+			if target, err = dialTarget(c.config, "tcp", host, c.dstIPs, port); err != nil {
+				_ = c.reply(dialErrorReply(err), nil)
+				c.logger.Printf("connect to %v failed: %v", addr, err)
+				return
+			}
+			if !c.setTarget(target) {
+				return
+			}
+			targetAddr = addr.String()
+			targetR = bufio.NewReader(target)
+		}
+
+		keepAlive, targetKeepAlive, err := c.forwardHTTP(req, target, targetR)
+		if err != nil {
+			c.logger.Printf("http %v %v: %v", req.Method, req.URL, err)
+			return
+		}
+		if !keepAlive {
+			return
+		}
+		if !targetKeepAlive {
+			_ = target.Close()
+			target = nil
+		}
+
+		// 等待下一个请求
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout))
+		if req, err = http.ReadRequest(c.httpReader); err != nil {
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// forwardHTTP 发送一个请求并把响应写回客户端, 返回客户端连接及远程连接是否可以继续使用
+func (c *connection) forwardHTTP(req *http.Request, target net.Conn, targetR *bufio.Reader) (keepAlive bool, targetKeepAlive bool, err error) {
+	clientClose := req.Close
+
+	removeHopHeaders(req.Header)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// 避免 Request.Write 添加默认的User-Agent
+		req.Header.Set("User-Agent", "")
+	}
+	req.Close = false
+
+	if err = req.Write(target); err != nil {
+		return false, false, err
+	}
+
+	for {
+		resp, err := http.ReadResponse(targetR, req)
+		if err != nil {
+			_ = c.reply(RepHostUnreachable, nil)
+			return false, false, err
+		}
+
+		// 1xx 中间响应, 继续读取最终响应
+		interim := resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols
+
+		targetClose := resp.Close
+		removeHopHeaders(resp.Header)
+		// 长度未知的响应体以关闭连接结束
+		if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && !interim && req.Method != http.MethodHead {
+			clientClose = true
+		}
+		resp.Close = clientClose
+
+		err = resp.Write(c.conn)
+		_ = resp.Body.Close()
+		if err != nil {
+			return false, false, err
+		}
+
+		if interim {
+			continue
+		}
+		return !clientClose, !targetClose, nil
+	}
+}
+
+// parseBasicAuth 解析 "Basic base64(user:password)"
+func parseBasicAuth(header string) (user, password string, ok bool) {
+	r := http.Request{Header: http.Header{"Authorization": []string{header}}}
+	return r.BasicAuth()
+}
+
+// httpTargetAddr host没有端口时使用默认端口
+func httpTargetAddr(host string, defaultPort int) (AddrByte, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(defaultPort))
+	}
+	return NewAddrByteFromString(host)
+}
+
+// writeHTTPStatus 回复状态行及额外的头部, 没有响应体
+func (c *connection) writeHTTPStatus(code int, header string) {
+	_, _ = fmt.Fprintf(c.conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\n\r\n", code, http.StatusText(code), header)
+}
+
+// newHTTPReply SOCKS5回复码对应的HTTP响应
+func newHTTPReply(rep byte) []byte {
+	var code int
+	switch rep {
+	case RepSuccess:
+		return []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	case RepRuleFailure:
+		code = http.StatusForbidden
+	case RepTTLExpired:
+		code = http.StatusGatewayTimeout
+	default:
+		code = http.StatusBadGateway
+	}
+	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code)))
+}
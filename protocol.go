@@ -84,7 +84,7 @@ type UserPassAuthReq struct {
 
 func NewUserPassAuthReq(username []byte, password []byte) *UserPassAuthReq {
 	return &UserPassAuthReq{
-		Ver:      SocksVersion,
+		Ver:      UserPassAuthVersion,
 		ULen:     byte(len(username)),
 		UserName: username,
 		PLen:     byte(len(password)),
@@ -148,7 +148,7 @@ func (p *UserPassAuthReply) ToBytes() []byte {
 
 func NewUserPassAuthReply(status byte) *UserPassAuthReply {
 	return &UserPassAuthReply{
-		Ver:    SocksVersion,
+		Ver:    UserPassAuthVersion,
 		Status: status,
 	}
 }
@@ -209,11 +209,15 @@ func NewRequest(cmd byte, addrByte AddrByte) *Request {
 }
 
 func (p *Request) Address() string {
+	return p.AddrByte().String()
+}
+
+func (p *Request) AddrByte() AddrByte {
 	var bAddr []byte
 	bAddr = append(bAddr, p.ATyp)
 	bAddr = append(bAddr, p.DstAddr...)
 	bAddr = append(bAddr, p.DstPort...)
-	return AddrByte(bAddr).String()
+	return bAddr
 }
 
 func (p *Request) ToBytes() []byte {
@@ -282,6 +286,7 @@ func NewReplyFrom(r io.Reader) (*Reply, error) {
 	}, nil
 }
 
+// UDPDatagram UDP转发的数据包 (RFC 1928 第7节), 服务端与客户端共用
 type UDPDatagram struct {
 	Rsv     []byte //0x00,0x00
 	Frag    byte
@@ -289,6 +294,8 @@ type UDPDatagram struct {
 	DstAddr []byte
 	DstPort []byte
 	Data    []byte
+
+	addr AddrByte // ATYP+DST.ADDR+DST.PORT
 }
 
 func (p *UDPDatagram) ToBytes() []byte {
@@ -302,12 +309,21 @@ func (p *UDPDatagram) ToBytes() []byte {
 	return b
 }
 
-func (p *UDPDatagram) Address() string {
+// AddrByte 数据包中的地址 ATYP+DST.ADDR+DST.PORT
+func (p *UDPDatagram) AddrByte() AddrByte {
+	if p.addr != nil {
+		return p.addr
+	}
+
 	var bAddr []byte
 	bAddr = append(bAddr, p.AType)
 	bAddr = append(bAddr, p.DstAddr...)
 	bAddr = append(bAddr, p.DstPort...)
-	return AddrByte(bAddr).String()
+	return bAddr
+}
+
+func (p *UDPDatagram) Address() string {
+	return p.AddrByte().String()
 }
 
 func NewUDPDatagram(addrByte AddrByte, data []byte) *UDPDatagram {
@@ -319,21 +335,37 @@ func NewUDPDatagram(addrByte AddrByte, data []byte) *UDPDatagram {
 		DstAddr: addr,
 		DstPort: port,
 		Data:    data,
+		addr:    addrByte,
 	}
 }
 
+// NewUDPDatagramFromBytes 解析数据包, 检查RSV及地址. 返回的各字段引用b, 不复制
 func NewUDPDatagramFromBytes(b []byte) (*UDPDatagram, error) {
 	if len(b) < 4 {
 		return nil, ErrBadRequest
 	}
+	if b[0] != 0 || b[1] != 0 {
+		return nil, fmt.Errorf("%w: udp rsv %#x%02x", ErrBadRequest, b[0], b[1])
+	}
 
 	bAddr, err := NewAddrByteFromByte(b[3:])
 	if err != nil {
 		return nil, err
 	}
+	if bAddr[0] == ATypDomain && bAddr[1] == 0 {
+		return nil, fmt.Errorf("%w: empty domain", ErrBadRequest)
+	}
 
-	data := b[3+len(bAddr):]
-	return NewUDPDatagram(bAddr, data), nil
+	aType, addr, port := bAddr.Split()
+	return &UDPDatagram{
+		Rsv:     b[:2],
+		Frag:    b[2],
+		AType:   aType,
+		DstAddr: addr,
+		DstPort: port,
+		Data:    b[3+len(bAddr):],
+		addr:    bAddr,
+	}, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -344,21 +376,26 @@ const PortLen = 2
 type AddrByte []byte
 
 func (a AddrByte) String() string {
-	var host, port string
+	host, port := a.HostPort()
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// HostPort 地址中的域名或IP, 及端口
+func (a AddrByte) HostPort() (host string, port int) {
 
 	switch a[0] { // address type
 	case ATypDomain:
 		host = string(a[2 : 2+int(a[1])])
-		port = strconv.Itoa((int(a[2+int(a[1])]) << 8) | int(a[2+int(a[1])+1]))
+		port = (int(a[2+int(a[1])]) << 8) | int(a[2+int(a[1])+1])
 	case ATypIPv4:
 		host = net.IP(a[1 : 1+net.IPv4len]).String()
-		port = strconv.Itoa((int(a[1+net.IPv4len]) << 8) | int(a[1+net.IPv4len+1]))
+		port = (int(a[1+net.IPv4len]) << 8) | int(a[1+net.IPv4len+1])
 	case ATypIPv6:
 		host = net.IP(a[1 : 1+net.IPv6len]).String()
-		port = strconv.Itoa((int(a[1+net.IPv6len]) << 8) | int(a[1+net.IPv6len+1]))
+		port = (int(a[1+net.IPv6len]) << 8) | int(a[1+net.IPv6len+1])
 	}
 
-	return net.JoinHostPort(host, port)
+	return host, port
 }
 
 func (a AddrByte) Split() (aType byte, addr []byte, port []byte) {
@@ -470,5 +507,5 @@ func NewAddrByteFromByte(b []byte) (AddrByte, error) {
 	if len(b) < endPos {
 		return nil, ErrBadRequest
 	}
-	return b[:endPos], nil
+	return b[:endPos:endPos], nil
 }
@@ -0,0 +1,74 @@
+package go_socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// handleResolve Tor RESOLVE: 解析DST.ADDR中的域名, 在BND.ADDR中回复地址, 优先IPv4
+func (c *connection) handleResolve(req *Request) {
+	host, _ := req.AddrByte().HostPort()
+
+	// 规则检查时已解析的, 使用检查过的地址
+	ips := c.dstIPs
+	var err error
+	if len(ips) == 0 {
+		ips, err = c.lookup(host)
+	}
+	if err != nil || len(ips) == 0 {
+		_ = c.reply(RepHostUnreachable, nil)
+		c.logger.Printf("resolve %v: %v", host, err)
+		return
+	}
+
+	ip := ips[0]
+	for _, v := range ips {
+		if v.To4() != nil {
+			ip = v
+			break
+		}
+	}
+
+	bAddr, err := NewAddrByteFromString(net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		_ = c.reply(RepServerFailure, nil)
+		c.logger.Println(err)
+		return
+	}
+	_ = c.reply(RepSuccess, bAddr)
+}
+
+// handleResolvePTR Tor RESOLVE_PTR: 反向解析DST.ADDR中的IP, 在BND.ADDR中回复域名
+func (c *connection) handleResolvePTR(req *Request) {
+	if req.ATyp != ATypIPv4 && req.ATyp != ATypIPv6 {
+		_ = c.reply(RepAddrTypeNotSupported, nil)
+		return
+	}
+	host, _ := req.AddrByte().HostPort()
+
+	resolver := net.DefaultResolver
+	if c.dns != nil {
+		resolver = c.dns.resolver
+	} else if c.config.EgressGuard != nil && c.config.EgressGuard.Resolver != nil {
+		resolver = c.config.EgressGuard.Resolver
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.DialTimeout)
+	defer cancel()
+
+	names, err := resolver.LookupAddr(ctx, host)
+	if err != nil || len(names) == 0 {
+		_ = c.reply(RepHostUnreachable, nil)
+		c.logger.Printf("resolve ptr %v: %v", host, err)
+		return
+	}
+
+	bAddr, err := NewAddrByteFromString(net.JoinHostPort(strings.TrimSuffix(names[0], "."), "0"))
+	if err != nil {
+		_ = c.reply(RepServerFailure, nil)
+		c.logger.Println(err)
+		return
+	}
+	_ = c.reply(RepSuccess, bAddr)
+}
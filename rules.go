@@ -0,0 +1,381 @@
+package go_socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrRule = errors.New("rule: invalid rule")
+
+type RuleAction int
+
+const (
+	RuleAllow RuleAction = iota
+	RuleDeny
+)
+
+func (a RuleAction) String() string {
+	if a == RuleDeny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// RuleSet 请求过滤, 拒绝时回复 RepRuleFailure. rule为匹配的规则, 用于日志, 没有匹配时为nil
+type RuleSet interface {
+	Allow(req *RuleRequest) (allow bool, rule *Rule)
+}
+
+// RuleRequest 规则匹配的请求信息
+type RuleRequest struct {
+	ClientAddr net.Addr
+	Identity   *Identity
+	Cmd        byte
+	Host       string // 目的域名, 目的为IP时为空
+	IP         net.IP // 目的IP, 目的为域名时为解析得到的一个地址, 未解析时为nil
+	Port       int
+}
+
+// NewRuleRequest 由目的地址构造请求信息
+func NewRuleRequest(clientAddr net.Addr, identity *Identity, cmd byte, dst AddrByte) *RuleRequest {
+	r := &RuleRequest{
+		ClientAddr: clientAddr,
+		Identity:   identity,
+		Cmd:        cmd,
+	}
+
+	aType, addr, port := dst.Split()
+	switch aType {
+	case ATypDomain:
+		r.Host = string(addr[1:])
+	default:
+		r.IP = net.IP(addr)
+	}
+	r.Port = int(port[0])<<8 | int(port[1])
+	return r
+}
+
+func (r *RuleRequest) String() string {
+	host := r.Host
+	if host == "" {
+		host = r.IP.String()
+	}
+	return fmt.Sprintf("cmd %v %v from %v(%v)", r.Cmd, net.JoinHostPort(host, strconv.Itoa(r.Port)), r.ClientAddr, r.Identity)
+}
+
+// Rule 一条过滤规则, 为空的条件匹配所有请求, 所有非空条件都满足时匹配
+type Rule struct {
+	Name   string
+	Action RuleAction
+
+	// 客户端地址, CIDR或IP
+	Clients []string
+	// 认证后的用户名
+	Users []string
+	// CmdConnect, CmdBind, CmdUdpAssociate, CmdResolve, CmdResolvePTR
+	Commands []byte
+	// 目的地址, CIDR或IP. 目的为域名时用解析得到的每个IP检查
+	Dests []string
+	// 目的域名: "example.com" 完全匹配, ".example.com" 匹配该域名及子域名,
+	// "*.example.com" 通配符, "regexp:^api[0-9]+\.example\.com$" 正则
+	Domains []string
+	// 目的端口, "443" 或 "8000-9000"
+	Ports []string
+
+	clients []*net.IPNet
+	dests   []*net.IPNet
+	domains []domainMatcher
+	ports   []portRange
+	index   int
+}
+
+func (r *Rule) String() string {
+	if r == nil {
+		return "default"
+	}
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("#%d(%v)", r.index, r.Action)
+}
+
+// Rules 有序的规则列表, 使用第一条匹配的规则, 没有匹配时使用默认动作
+type Rules struct {
+	rules         []*Rule
+	defaultAction RuleAction
+}
+
+// NewRules 检查并编译规则
+func NewRules(defaultAction RuleAction, rules ...Rule) (*Rules, error) {
+	p := &Rules{defaultAction: defaultAction}
+	for i := range rules {
+		r := rules[i]
+		r.index = i
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d %v: %w", i, r.Name, err)
+		}
+		p.rules = append(p.rules, &r)
+	}
+	return p, nil
+}
+
+func (p *Rules) Allow(req *RuleRequest) (bool, *Rule) {
+	for _, r := range p.rules {
+		if r.match(req) {
+			return r.Action == RuleAllow, r
+		}
+	}
+	return p.defaultAction == RuleAllow, nil
+}
+
+// needIP 目的为域名时是否需要先解析, 用解析得到的IP检查规则. 其他RuleSet实现总是解析
+func needIP(rules RuleSet) bool {
+	p, ok := rules.(*Rules)
+	if !ok {
+		return true
+	}
+	for _, r := range p.rules {
+		if len(r.dests) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// allowResolved 用解析得到的每个IP检查规则, 任一IP被拒绝时拒绝
+func allowResolved(rules RuleSet, req *RuleRequest, ips []net.IP) (bool, *Rule) {
+	if len(ips) == 0 {
+		return rules.Allow(req)
+	}
+
+	var rule *Rule
+	for _, ip := range ips {
+		r := *req
+		r.IP = ip
+
+		allow, matched := rules.Allow(&r)
+		if !allow {
+			return false, matched
+		}
+		rule = matched
+	}
+	return true, rule
+}
+
+func (r *Rule) compile() error {
+	var err error
+	if r.clients, err = parseCIDRs(r.Clients); err != nil {
+		return err
+	}
+	if r.dests, err = parseCIDRs(r.Dests); err != nil {
+		return err
+	}
+
+	for _, d := range r.Domains {
+		m, err := newDomainMatcher(d)
+		if err != nil {
+			return err
+		}
+		r.domains = append(r.domains, m)
+	}
+
+	for _, s := range r.Ports {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, pr)
+	}
+
+	return nil
+}
+
+func (r *Rule) match(req *RuleRequest) bool {
+	if len(r.clients) > 0 && !matchCIDRs(r.clients, addrIP(req.ClientAddr)) {
+		return false
+	}
+
+	if len(r.Users) > 0 {
+		if req.Identity == nil || req.Identity.User == "" {
+			return false
+		}
+		found := false
+		for _, u := range r.Users {
+			if u == req.Identity.User {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Commands) > 0 && !bytesContains(r.Commands, req.Cmd) {
+		return false
+	}
+
+	if len(r.dests) > 0 && !matchCIDRs(r.dests, req.IP) {
+		return false
+	}
+
+	if len(r.domains) > 0 {
+		if req.Host == "" {
+			return false
+		}
+		host := strings.ToLower(strings.TrimSuffix(req.Host, "."))
+		found := false
+		for _, m := range r.domains {
+			if m.match(host) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 {
+		found := false
+		for _, pr := range r.ports {
+			if req.Port >= pr.min && req.Port <= pr.max {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+type domainMatcher struct {
+	exact   string
+	suffix  string
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newDomainMatcher(s string) (domainMatcher, error) {
+	if strings.HasPrefix(s, "regexp:") {
+		re, err := regexp.Compile(s[len("regexp:"):])
+		if err != nil {
+			return domainMatcher{}, fmt.Errorf("%w: domain %v: %v", ErrRule, s, err)
+		}
+		return domainMatcher{re: re}, nil
+	}
+
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	switch {
+	case s == "" || s == ".":
+		return domainMatcher{}, fmt.Errorf("%w: empty domain", ErrRule)
+	case strings.HasPrefix(s, "."):
+		return domainMatcher{suffix: s}, nil
+	case strings.Contains(s, "*"):
+		if _, err := path.Match(s, ""); err != nil {
+			return domainMatcher{}, fmt.Errorf("%w: domain %v: %v", ErrRule, s, err)
+		}
+		return domainMatcher{pattern: s}, nil
+	default:
+		return domainMatcher{exact: s}, nil
+	}
+}
+
+func (m domainMatcher) match(host string) bool {
+	switch {
+	case m.re != nil:
+		return m.re.MatchString(host)
+	case m.suffix != "":
+		return host == m.suffix[1:] || strings.HasSuffix(host, m.suffix)
+	case m.pattern != "":
+		ok, _ := path.Match(m.pattern, host)
+		return ok
+	default:
+		return host == m.exact
+	}
+}
+
+type portRange struct {
+	min, max int
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+
+	min, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	max, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err1 != nil || err2 != nil || min > max {
+		return portRange{}, fmt.Errorf("%w: port %v", ErrRule, s)
+	}
+	return portRange{min: int(min), max: int(max)}, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: address %v", ErrRule, s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cidr %v: %v", ErrRule, s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func matchCIDRs(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP net.Addr中的IP, 非IP地址返回nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func bytesContains(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
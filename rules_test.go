@@ -0,0 +1,213 @@
+package go_socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000}
+	guest := &Identity{User: "guest"}
+
+	tests := []struct {
+		name string
+		rule Rule
+		req  RuleRequest
+		want bool
+	}{
+		{
+			name: "empty rule matches all",
+			rule: Rule{},
+			req:  RuleRequest{ClientAddr: client, Cmd: CmdConnect, Host: "example.com", Port: 80},
+			want: true,
+		},
+		{
+			name: "client cidr",
+			rule: Rule{Clients: []string{"192.168.1.0/24"}},
+			req:  RuleRequest{ClientAddr: client, IP: net.ParseIP("1.1.1.1"), Port: 80},
+			want: true,
+		},
+		{
+			name: "client cidr mismatch",
+			rule: Rule{Clients: []string{"10.0.0.0/8"}},
+			req:  RuleRequest{ClientAddr: client, IP: net.ParseIP("1.1.1.1"), Port: 80},
+			want: false,
+		},
+		{
+			name: "user",
+			rule: Rule{Users: []string{"admin", "guest"}},
+			req:  RuleRequest{Identity: guest, Host: "example.com", Port: 80},
+			want: true,
+		},
+		{
+			name: "user without identity",
+			rule: Rule{Users: []string{"guest"}},
+			req:  RuleRequest{Host: "example.com", Port: 80},
+			want: false,
+		},
+		{
+			name: "command",
+			rule: Rule{Commands: []byte{CmdBind, CmdUdpAssociate}},
+			req:  RuleRequest{Cmd: CmdConnect, Host: "example.com", Port: 80},
+			want: false,
+		},
+		{
+			name: "dest ip",
+			rule: Rule{Dests: []string{"10.0.0.0/8"}},
+			req:  RuleRequest{IP: net.ParseIP("10.1.2.3"), Port: 80},
+			want: true,
+		},
+		{
+			name: "dest resolved ip of domain",
+			rule: Rule{Dests: []string{"10.0.0.0/8"}},
+			req:  RuleRequest{Host: "db.example.com", IP: net.ParseIP("10.1.2.3"), Port: 80},
+			want: true,
+		},
+		{
+			name: "dest unresolved domain",
+			rule: Rule{Dests: []string{"10.0.0.0/8"}},
+			req:  RuleRequest{Host: "db.example.com", Port: 80},
+			want: false,
+		},
+		{
+			name: "dest single ipv6",
+			rule: Rule{Dests: []string{"::1"}},
+			req:  RuleRequest{IP: net.ParseIP("::1"), Port: 80},
+			want: true,
+		},
+		{
+			name: "domain exact",
+			rule: Rule{Domains: []string{"example.com"}},
+			req:  RuleRequest{Host: "Example.COM.", Port: 80},
+			want: true,
+		},
+		{
+			name: "domain exact no subdomain",
+			rule: Rule{Domains: []string{"example.com"}},
+			req:  RuleRequest{Host: "www.example.com", Port: 80},
+			want: false,
+		},
+		{
+			name: "domain suffix",
+			rule: Rule{Domains: []string{".example.com"}},
+			req:  RuleRequest{Host: "a.b.example.com", Port: 80},
+			want: true,
+		},
+		{
+			name: "domain suffix self",
+			rule: Rule{Domains: []string{".example.com"}},
+			req:  RuleRequest{Host: "example.com", Port: 80},
+			want: true,
+		},
+		{
+			name: "domain suffix lookalike",
+			rule: Rule{Domains: []string{".example.com"}},
+			req:  RuleRequest{Host: "badexample.com", Port: 80},
+			want: false,
+		},
+		{
+			name: "domain wildcard",
+			rule: Rule{Domains: []string{"*.example.com"}},
+			req:  RuleRequest{Host: "www.example.com", Port: 80},
+			want: true,
+		},
+		{
+			name: "domain regexp",
+			rule: Rule{Domains: []string{`regexp:^api[0-9]+\.example\.com$`}},
+			req:  RuleRequest{Host: "api12.example.com", Port: 80},
+			want: true,
+		},
+		{
+			name: "domain against ip",
+			rule: Rule{Domains: []string{".example.com"}},
+			req:  RuleRequest{IP: net.ParseIP("1.1.1.1"), Port: 80},
+			want: false,
+		},
+		{
+			name: "port range",
+			rule: Rule{Ports: []string{"22", "8000-9000"}},
+			req:  RuleRequest{Host: "example.com", Port: 8080},
+			want: true,
+		},
+		{
+			name: "port mismatch",
+			rule: Rule{Ports: []string{"22", "8000-9000"}},
+			req:  RuleRequest{Host: "example.com", Port: 80},
+			want: false,
+		},
+		{
+			name: "conditions are anded",
+			rule: Rule{Dests: []string{"10.0.0.0/8"}, Domains: []string{".internal"}},
+			req:  RuleRequest{Host: "db.example.com", IP: net.ParseIP("10.1.2.3"), Port: 80},
+			want: false,
+		},
+		{
+			name: "all conditions",
+			rule: Rule{Clients: []string{"192.168.0.0/16"}, Users: []string{"guest"}, Commands: []byte{CmdConnect}, Dests: []string{"10.0.0.0/8"}, Domains: []string{".internal"}, Ports: []string{"443"}},
+			req:  RuleRequest{ClientAddr: client, Identity: guest, Cmd: CmdConnect, Host: "db.internal", IP: net.ParseIP("10.1.2.3"), Port: 443},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		r := tt.rule
+		if err := r.compile(); err != nil {
+			t.Fatalf("%v: compile: %v", tt.name, err)
+		}
+		if got := r.match(&tt.req); got != tt.want {
+			t.Errorf("%v: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowResolved(t *testing.T) {
+	rules, err := NewRules(RuleAllow,
+		Rule{Name: "no-internal-ip", Action: RuleDeny, Dests: []string{"10.0.0.0/8"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ips  []string
+		want bool
+	}{
+		{name: "public", ips: []string{"1.1.1.1"}, want: true},
+		{name: "internal", ips: []string{"10.1.2.3"}, want: false},
+		{name: "any internal", ips: []string{"1.1.1.1", "10.1.2.3"}, want: false},
+	}
+
+	for _, tt := range tests {
+		var ips []net.IP
+		for _, s := range tt.ips {
+			ips = append(ips, net.ParseIP(s))
+		}
+
+		req := &RuleRequest{Cmd: CmdConnect, Host: "db.example.com", Port: 80}
+		if got, _ := allowResolved(rules, req, ips); got != tt.want {
+			t.Errorf("%v: allow = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if !needIP(rules) {
+		t.Error("needIP = false for rules with Dests")
+	}
+}
+
+func TestRuleCompileError(t *testing.T) {
+	tests := []Rule{
+		{Clients: []string{"not-an-ip"}},
+		{Dests: []string{"10.0.0.0/33"}},
+		{Domains: []string{"."}},
+		{Domains: []string{"regexp:("}},
+		{Ports: []string{"9000-8000"}},
+		{Ports: []string{"65536"}},
+	}
+
+	for i, r := range tests {
+		if err := r.compile(); err == nil {
+			t.Errorf("rule %d: compile succeeded, want error", i)
+		}
+	}
+}
@@ -1,119 +1,447 @@
 package go_socks5
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 )
 
-// server client: "golang.org/x/net/proxy" "github.com/0990/socks5/cmd/client"
-type server struct {
-	listenerTCP *net.TCPListener
-	listenerUDP *net.UDPConn
+var ErrServerClosed = errors.New("socks5: server closed")
+
+// shutdownPollInterval Shutdown时检查活动连接的间隔
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Server socks5 server. client: "golang.org/x/net/proxy" "github.com/0990/socks5/cmd/client"
+type Server struct {
+	config *Config
+	logger Logger
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	udpConns   map[*net.UDPConn]struct{}
+	activeConn map[*connection]struct{}
+	udpAssocs  *udpAssociations
+	dns        *dnsCache // UDP转发及RESOLVE共用的域名解析缓存
+	tlsConfig  *tls.Config
+	certs      *CertReloader // 证书文件自动重新加载, 服务结束时停止
+	udpLocal   *net.UDPAddr  // udp转发监听的地址
+	hostAddr   AddrByte      // 无法从连接得到本地地址时回复的udp地址
+	inShutdown bool
+	doneCh     chan struct{}
+	doneOnce   sync.Once
+
+	// 所有后台goroutine
+	wg sync.WaitGroup
 }
 
-func NewServer() *server {
-	return &server{}
+func NewServer(config *Config) (*Server, error) {
+	conf, err := config.check()
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	var certs *CertReloader
+	if conf.TLSListenAddr != "" || conf.TLSConfig != nil {
+		if tlsConfig, certs, err = conf.newTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	dns := newConfigDNSCache(conf)
+	return &Server{
+		config:     conf,
+		logger:     conf.Logger,
+		listeners:  make(map[net.Listener]struct{}),
+		udpConns:   make(map[*net.UDPConn]struct{}),
+		activeConn: make(map[*connection]struct{}),
+		udpAssocs:  newUDPAssociations(conf, dns),
+		dns:        dns,
+		tlsConfig:  tlsConfig,
+		certs:      certs,
+		doneCh:     make(chan struct{}),
+	}, nil
 }
 
-func (c *server) Start(port int) error {
-	var err error
+// Start 按配置监听TCP和UDP端口, 在后台处理请求
+func (c *Server) Start() error {
+	tcpNetwork, udpNetwork := c.config.networks()
 
-	// 接收代理请求、验证
-	c.listenerTCP, err = net.ListenTCP("tcp4", &net.TCPAddr{
-		IP:   net.IPv4zero,
-		Port: port,
-	})
+	tcpAddr, err := net.ResolveTCPAddr(tcpNetwork, c.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	udpAddr, err := net.ResolveUDPAddr(udpNetwork, c.config.UDPListenAddr)
 	if err != nil {
 		return err
 	}
 
-	// socks代理中的udp转发
-	c.listenerUDP, err = net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: port,
-	})
-
-	// udp转发都返回这个地址, 如果是公网, 使用配置地址
-	hostIp, err := GetHostIP()
+	// 接收代理请求、验证. 地址为空或通配地址时同时监听IPv4/IPv6
+	listenerTCP, err := net.ListenTCP(tcpNetwork, tcpAddr)
 	if err != nil {
 		return err
 	}
-	udpAddr, err := NewAddrByteFromString(fmt.Sprintf("%v:%d", hostIp, port))
+
+	// socks代理中的udp转发
+	listenerUDP, err := net.ListenUDP(udpNetwork, udpAddr)
 	if err != nil {
+		_ = listenerTCP.Close()
 		return err
 	}
 
-	go func() {
-		for {
-			// socks代理
-			conn, err := c.listenerTCP.AcceptTCP()
-			if err != nil {
-				log.Println(err)
-				return
-			}
+	if err = c.setUDP(listenerUDP); err != nil {
+		_ = listenerTCP.Close()
+		_ = listenerUDP.Close()
+		return err
+	}
 
-			_ = conn.SetKeepAlive(true)
-			_ = conn.SetReadBuffer(512 * 1024)
-			_ = conn.SetWriteBuffer(512 * 1024)
+	// socks over tls
+	var listenerTLS net.Listener
+	if c.config.TLSListenAddr != "" {
+		if listenerTLS, err = net.Listen(tcpNetwork, c.config.TLSListenAddr); err != nil {
+			_ = listenerTCP.Close()
+			_ = listenerUDP.Close()
+			return err
+		}
+	}
 
-			// 处理新连接
-			go NewConnection(conn, udpAddr).Handle()
+	go func() {
+		if err := c.ServeUDP(listenerUDP); err != nil && err != ErrServerClosed {
+			c.logger.Println(err)
 		}
 	}()
 
 	go func() {
-		// 来自socks代理客户端的连接 (没有和代理的tcp connection关联, 使用单端口接收转发请求, 不容易关联tcp connection)
-		var clientList sync.Map
-
-		buffer := make([]byte, 65535)
-		for {
-			// 来自代理端的数据, 接收后转发给remote(数据包中包含remote地址)
-			n, fromAddr, err := c.listenerUDP.ReadFromUDP(buffer)
-			if err != nil {
-				return
+		if err := c.Serve(listenerTCP); err != nil && err != ErrServerClosed {
+			c.logger.Println(err)
+		}
+	}()
+
+	if listenerTLS != nil {
+		go func() {
+			if err := c.ServeTLS(listenerTLS); err != nil && err != ErrServerClosed {
+				c.logger.Println(err)
 			}
-			data := buffer[:n]
-			log.Println("read udp from: ", fromAddr.String())
-
-			var cli *UdpClient
-			tmpCli, found := clientList.Load(fromAddr.String())
-			if !found {
-				cli = &UdpClient{
-					listenerUDP: c.listenerUDP,
-					addr:        fromAddr,
-					OnError: func(err error, c *UdpClient) {
-						clientList.Delete(c.addr.String())
-					},
-				}
+		}()
+	}
 
-				// 连接远程
-				if err = cli.Connect(data); err != nil {
-					log.Println(err)
-					continue
-				}
+	return nil
+}
+
+// ServeTLS 在listener上接收TLS连接, 握手后按Serve处理. 需要配置证书或TLSConfig
+func (c *Server) ServeTLS(l net.Listener) error {
+	if c.tlsConfig == nil {
+		_ = l.Close()
+		return ErrTLSConfig
+	}
+	return c.Serve(&tlsListener{Listener: l, config: c.tlsConfig, tune: c.tuneTCPConn})
+}
 
-				// 保存udp client
-				clientList.Store(fromAddr.String(), cli)
-			} else {
-				cli = tmpCli.(*UdpClient)
+// Serve 在listener上接收socks连接, 直到listener出错. 未调用Start/ServeUDP时不支持UDP ASSOCIATE
+func (c *Server) Serve(l net.Listener) error {
+	if !c.trackListener(l) {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	defer c.untrackListener(l)
+	defer c.wg.Done()
+
+	var tempDelay time.Duration
+	for {
+		// socks代理
+		conn, err := l.Accept()
+		if err != nil {
+			if c.shuttingDown() {
+				return ErrServerClosed
 			}
 
-			// 转发数据
-			if err = cli.Handle(data); err != nil {
-				log.Println(err)
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				c.logger.Printf("accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
 			}
+			return err
 		}
+		tempDelay = 0
+
+		// 处理新连接
+		go c.ServeConn(conn)
+	}
+}
+
+// ServeConn 在已建立的连接上处理socks5握手及请求, 返回时连接已关闭
+func (c *Server) ServeConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		c.tuneTCPConn(tcpConn)
+	}
+
+	c.mu.Lock()
+	cc := newConnection(conn, c.udpReplyAddrLocked(conn.LocalAddr()), c.config)
+	cc.associations = c.udpAssocs
+	cc.dns = c.dns
+	if c.inShutdown {
+		c.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	c.activeConn[cc] = struct{}{}
+	c.wg.Add(1)
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.activeConn, cc)
+		c.mu.Unlock()
+		c.wg.Done()
 	}()
 
+	cc.Handle()
+}
+
+// ServeUDP 在conn上处理UDP ASSOCIATE的转发数据, 直到conn出错
+func (c *Server) ServeUDP(conn *net.UDPConn) error {
+	c.mu.Lock()
+	_, isSet := c.udpConns[conn]
+	c.mu.Unlock()
+
+	if !isSet {
+		if err := c.setUDP(conn); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	if c.inShutdown {
+		c.mu.Unlock()
+		_ = conn.Close()
+		return ErrServerClosed
+	}
+	c.wg.Add(1)
+	c.mu.Unlock()
+	defer c.wg.Done()
+
+	buffer := make([]byte, 65535)
+	for {
+		// 来自代理端的数据, 接收后转发给remote(数据包中包含remote地址)
+		n, fromAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if c.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		data := buffer[:n]
+
+		// 只接受有UDP ASSOCIATE会话的客户端
+		assoc := c.udpAssocs.lookup(fromAddr)
+		if assoc == nil {
+			c.udpAssocs.dropUnassociated()
+			continue
+		}
+
+		// 放入会话的队列, 解析域名等耗时操作不阻塞其他客户端
+		assoc.enqueue(conn, fromAddr, data, c.config, &c.wg)
+	}
+}
+
+// UDPStats UDP会话统计
+func (c *Server) UDPStats() UDPStats {
+	return c.udpAssocs.stats()
+}
+
+// Shutdown 停止接收新连接, 等待活动连接结束后关闭UDP转发.
+// ctx结束时强制关闭剩余的连接并返回ctx.Err()
+func (c *Server) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.inShutdown = true
+	err := c.closeListenersLocked()
+	c.mu.Unlock()
+	c.waitDone()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		if len(c.activeConn) == 0 {
+			c.closeUDPLocked()
+			c.mu.Unlock()
+			return err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.closeConnsLocked()
+			c.closeUDPLocked()
+			c.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close 立即关闭所有监听、连接及UDP转发
+func (c *Server) Close() error {
+	c.mu.Lock()
+	c.inShutdown = true
+	err := c.closeListenersLocked()
+	c.closeConnsLocked()
+	c.closeUDPLocked()
+	c.mu.Unlock()
+	c.waitDone()
+
+	return err
+}
+
+// Stop 同 Close
+func (c *Server) Stop() {
+	_ = c.Close()
+}
+
+// Done 在Shutdown或Close之后, 所有goroutine退出时关闭
+func (c *Server) Done() <-chan struct{} {
+	return c.doneCh
+}
+
+func (c *Server) shuttingDown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inShutdown
+}
+
+// waitDone 等待所有goroutine退出后关闭doneCh. 必须在inShutdown设置后调用, 之后不会再有wg.Add
+func (c *Server) waitDone() {
+	c.doneOnce.Do(func() {
+		go func() {
+			c.wg.Wait()
+			if c.certs != nil {
+				c.certs.Close()
+			}
+			close(c.doneCh)
+		}()
+	})
+}
+
+func (c *Server) trackListener(l net.Listener) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inShutdown {
+		return false
+	}
+	c.listeners[l] = struct{}{}
+	c.wg.Add(1)
+	return true
+}
+
+func (c *Server) untrackListener(l net.Listener) {
+	c.mu.Lock()
+	delete(c.listeners, l)
+	c.mu.Unlock()
+}
+
+func (c *Server) closeListenersLocked() error {
+	var err error
+	for l := range c.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (c *Server) closeConnsLocked() {
+	for cc := range c.activeConn {
+		cc.Close()
+	}
+}
+
+func (c *Server) closeUDPLocked() {
+	for conn := range c.udpConns {
+		_ = conn.Close()
+		delete(c.udpConns, conn)
+	}
+}
+
+// setUDP 设置udp转发连接
+func (c *Server) setUDP(conn *net.UDPConn) error {
+	local := conn.LocalAddr().(*net.UDPAddr)
+
+	var hostAddr AddrByte
+	if local.IP == nil || local.IP.IsUnspecified() {
+		hostIp, err := GetHostIP()
+		if err != nil {
+			c.logger.Printf("get host ip: %v", err)
+		}
+		if hostAddr, err = NewAddrByteFromString(net.JoinHostPort(hostIp, strconv.Itoa(local.Port))); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.udpConns[conn] = struct{}{}
+	c.udpLocal = local
+	c.hostAddr = hostAddr
+	c.mu.Unlock()
 	return nil
 }
 
-func (c *server) Stop() {
-	_ = c.listenerTCP.Close()
-	_ = c.listenerUDP.Close()
+func (c *Server) tuneTCPConn(conn *net.TCPConn) {
+	if c.config.DisableKeepAlive {
+		_ = conn.SetKeepAlive(false)
+	} else {
+		_ = conn.SetKeepAlive(true)
+		if c.config.KeepAlivePeriod > 0 {
+			_ = conn.SetKeepAlivePeriod(c.config.KeepAlivePeriod)
+		}
+	}
+	_ = conn.SetReadBuffer(c.config.ReadBufferSize)
+	_ = conn.SetWriteBuffer(c.config.WriteBufferSize)
+}
+
+// udpReplyAddrLocked UDP ASSOCIATE 回复的地址, 与客户端连接的本地地址同一协议族. 没有udp转发时返回nil
+func (c *Server) udpReplyAddrLocked(local net.Addr) AddrByte {
+	if c.udpLocal == nil {
+		return nil
+	}
+
+	var localIP net.IP
+	if tcpAddr, ok := local.(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	isIPv6 := localIP != nil && localIP.To4() == nil
+
+	// 如果是公网, 使用配置地址
+	if adv := c.config.advertiseAddr(isIPv6); adv != nil {
+		return adv
+	}
+
+	if c.udpLocal.IP != nil && !c.udpLocal.IP.IsUnspecified() {
+		addr, _ := NewAddrByteFromString(c.udpLocal.String())
+		return addr
+	}
+
+	// 客户端连接的本地地址 + udp端口
+	if localIP != nil && !localIP.IsUnspecified() {
+		addr, _ := NewAddrByteFromString(net.JoinHostPort(localIP.String(), strconv.Itoa(c.udpLocal.Port)))
+		return addr
+	}
+
+	return c.hostAddr
 }
 
 // GetHostIP get pc local host ip address
@@ -126,6 +454,9 @@ func GetHostIP() (string, error) {
 		_ = conn.Close()
 	}()
 
-	var ip = strings.Split(conn.LocalAddr().String(), ":")[0]
+	ip, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return "127.0.0.1", err
+	}
 	return ip, nil
 }
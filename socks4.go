@@ -0,0 +1,159 @@
+package go_socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	Socks4Version byte = 0x04
+
+	Socks4RepGranted  byte = 0x5a
+	Socks4RepRejected byte = 0x5b
+)
+
+var (
+	ErrSocks4Disabled = errors.New("socks4 disabled")
+	ErrSocks4Auth     = errors.New("socks4 requires no auth method")
+)
+
+// socks4MaxField USERID及域名的最大长度
+const socks4MaxField = 255
+
+// Socks4Request SOCKS4/4a 请求. DSTIP为0.0.0.x(x不为0)时为4a, 域名在USERID之后
+type Socks4Request struct {
+	Ver     byte
+	Cmd     byte
+	DstPort []byte //2 bytes
+	DstIP   []byte //4 bytes
+	UserID  string
+	Domain  string
+}
+
+func NewSocks4RequestFrom(r io.Reader) (*Socks4Request, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	req := &Socks4Request{
+		Ver:     b[0],
+		Cmd:     b[1],
+		DstPort: b[2:4],
+		DstIP:   b[4:8],
+	}
+
+	userID, err := readNullString(r)
+	if err != nil {
+		return nil, err
+	}
+	req.UserID = userID
+
+	if req.isSocks4a() {
+		if req.Domain, err = readNullString(r); err != nil {
+			return nil, err
+		}
+		if req.Domain == "" {
+			return nil, fmt.Errorf("%w: socks4a empty domain", ErrBadRequest)
+		}
+	}
+	return req, nil
+}
+
+func (p *Socks4Request) isSocks4a() bool {
+	return p.DstIP[0] == 0 && p.DstIP[1] == 0 && p.DstIP[2] == 0 && p.DstIP[3] != 0
+}
+
+// AddrByte 转换为SOCKS5的地址, 4a使用域名
+func (p *Socks4Request) AddrByte() AddrByte {
+	var bAddr []byte
+	if p.Domain != "" {
+		bAddr = append(bAddr, ATypDomain, byte(len(p.Domain)))
+		bAddr = append(bAddr, p.Domain...)
+	} else {
+		bAddr = append(bAddr, ATypIPv4)
+		bAddr = append(bAddr, p.DstIP...)
+	}
+	bAddr = append(bAddr, p.DstPort...)
+	return bAddr
+}
+
+func (p *Socks4Request) ToBytes() []byte {
+	ret := []byte{p.Ver, p.Cmd}
+	ret = append(ret, p.DstPort...)
+	ret = append(ret, p.DstIP...)
+	ret = append(ret, p.UserID...)
+	ret = append(ret, 0)
+	if p.Domain != "" {
+		ret = append(ret, p.Domain...)
+		ret = append(ret, 0)
+	}
+	return ret
+}
+
+// NewSocks4Reply SOCKS4 回复. addrByte为IPv4时回复其地址及端口, 否则为0
+func NewSocks4Reply(granted bool, addrByte AddrByte) []byte {
+	ret := make([]byte, 8)
+	ret[1] = Socks4RepRejected
+	if granted {
+		ret[1] = Socks4RepGranted
+	}
+
+	if len(addrByte) == 1+net.IPv4len+PortLen && addrByte[0] == ATypIPv4 {
+		copy(ret[2:4], addrByte[1+net.IPv4len:])
+		copy(ret[4:8], addrByte[1:1+net.IPv4len])
+	}
+	return ret
+}
+
+func readNullString(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) >= socks4MaxField {
+			return "", fmt.Errorf("%w: socks4 field too long", ErrBadRequest)
+		}
+		s = append(s, b[0])
+	}
+}
+
+// handshake4 SOCKS4/4a 请求, 只支持CONNECT及BIND. USERID不能用于认证, 只在配置了无认证或客户端证书认证时接受
+func (c *connection) handshake4(r io.Reader) (*Request, error) {
+	req4, err := NewSocks4RequestFrom(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var noAuth bool
+	for _, a := range c.config.Authenticators {
+		if a.Method() == MethodNoAuth {
+			noAuth = true
+			break
+		}
+	}
+	if !noAuth && !c.certOnly() {
+		_ = c.reply(RepRuleFailure, nil)
+		return nil, ErrSocks4Auth
+	}
+	if c.identity, err = c.bindTLSIdentity(&Identity{Method: MethodNoAuth}); err != nil {
+		_ = c.reply(RepRuleFailure, nil)
+		return nil, err
+	}
+
+	if req4.Cmd != CmdConnect && req4.Cmd != CmdBind {
+		_ = c.reply(RepCmdNotSupported, nil)
+		return nil, fmt.Errorf("%w: socks4 cmd %v", ErrCmdNotSupport, req4.Cmd)
+	}
+
+	req := NewRequest(req4.Cmd, req4.AddrByte())
+	c.logger.Printf("socks4 request %v %v from %v userid %q", req4.Cmd, req.Address(), c.conn.RemoteAddr(), req4.UserID)
+	return req, nil
+}
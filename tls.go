@@ -0,0 +1,267 @@
+package go_socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCertReloadInterval 检查证书文件修改的间隔
+const DefaultCertReloadInterval = 5 * time.Second
+
+var (
+	ErrTLSIdentity = errors.New("tls: client certificate identity mismatch")
+	ErrTLSConfig   = errors.New("tls: not configured")
+)
+
+// TLSIdentityMode 客户端证书的身份与SOCKS认证的关系
+type TLSIdentityMode int
+
+const (
+	// TLSIdentityOnly 客户端证书认证后不再需要SOCKS认证, 证书的名称作为用户名
+	TLSIdentityOnly TLSIdentityMode = iota
+	// TLSIdentityCombine 还需要SOCKS认证, 认证的用户名必须与证书的名称一致
+	TLSIdentityCombine
+)
+
+// CertReloader 证书及私钥文件, 修改后自动重新加载, 已建立的连接不受影响. 用于 tls.Config.GetCertificate
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// NewCertReloader 加载证书, 每interval检查一次文件是否修改. interval为0时使用默认值, 小于0时不自动重新加载
+func NewCertReloader(certFile, keyFile string, interval time.Duration, logger Logger) (*CertReloader, error) {
+	if logger == nil {
+		logger = stdLogger{}
+	}
+
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		closeCh:  make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	if interval == 0 {
+		interval = DefaultCertReloadInterval
+	}
+	if interval > 0 {
+		go r.watch(interval)
+	}
+
+	return r, nil
+}
+
+// GetCertificate 当前的证书
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reload 重新加载证书, 失败时保留原来的证书
+func (r *CertReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// Close 停止自动重新加载
+func (r *CertReloader) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closeCh)
+	})
+}
+
+// lastModified 证书及私钥文件中较晚的修改时间
+func (r *CertReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+func (r *CertReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := r.lastModified()
+		if err != nil {
+			r.logger.Printf("certificate %v: %v", r.certFile, err)
+			continue
+		}
+
+		r.mu.RLock()
+		changed := !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err = r.Reload(); err != nil {
+			r.logger.Printf("reload certificate: %v", err)
+			continue
+		}
+		r.logger.Printf("reload certificate %v", r.certFile)
+	}
+}
+
+// newTLSConfig 按配置的证书文件创建TLS配置. 配置了TLSConfig时直接使用
+func (c *Config) newTLSConfig() (*tls.Config, *CertReloader, error) {
+	if c.TLSConfig != nil {
+		return c.TLSConfig, nil, nil
+	}
+
+	certs, err := NewCertReloader(c.TLSCertFile, c.TLSKeyFile, 0, c.Logger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conf := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if c.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			certs.Close()
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			certs.Close()
+			return nil, nil, fmt.Errorf("%v: no certificate", c.TLSClientCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, certs, nil
+}
+
+// tlsListener 接收TCP连接, 调整socket参数后进行TLS握手
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+	tune   func(conn *net.TCPConn)
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && l.tune != nil {
+		l.tune(tcpConn)
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+// certUser 客户端证书的名称: Subject CN, 没有时使用第一个SAN(DNS, email, URI)
+func certUser(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// tlsHandshake TLS握手, 记录验证过的客户端证书的名称
+func (c *connection) tlsHandshake(conn *tls.Conn) error {
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		c.tlsUser = certUser(state.VerifiedChains[0][0])
+	}
+	return nil
+}
+
+// certOnly 客户端证书可以替代SOCKS认证
+func (c *connection) certOnly() bool {
+	return c.tlsUser != "" && c.config.TLSIdentity == TLSIdentityOnly
+}
+
+// bindTLSIdentity 合并客户端证书的身份. 认证没有用户名时使用证书的名称, 用户名不一致时返回错误
+func (c *connection) bindTLSIdentity(identity *Identity) (*Identity, error) {
+	if c.tlsUser == "" {
+		return identity, nil
+	}
+
+	if identity.User == "" {
+		if !c.certOnly() {
+			return nil, fmt.Errorf("%w: %q requires authentication", ErrTLSIdentity, c.tlsUser)
+		}
+		return &Identity{Method: identity.Method, User: c.tlsUser}, nil
+	}
+	if identity.User != c.tlsUser {
+		return nil, fmt.Errorf("%w: user %q, certificate %q", ErrTLSIdentity, identity.User, c.tlsUser)
+	}
+	return identity, nil
+}
+
+// TLSForwardDialer 使用TLS连接代理服务器, 作为客户端的底层dialer,
+// 如 proxy.SOCKS5("tcp", addr, auth, &TLSForwardDialer{Config: conf})
+type TLSForwardDialer struct {
+	// 为nil时使用默认配置, ServerName取自地址
+	Config *tls.Config
+	// 连接及握手超时, 0 不超时
+	Timeout time.Duration
+}
+
+func (d *TLSForwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: d.Timeout}, network, addr, d.Config)
+}
@@ -1,72 +1,65 @@
 package go_socks5
 
 import (
-	"bytes"
-	"encoding/binary"
-	"errors"
+	"context"
 	"fmt"
-	"io"
-	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type HandShake struct {
-	header []byte
-	body   []byte
-
-	ip     net.IP
-	port   int
-	domain string
-}
-
-func (c *HandShake) Address() string {
-	var host = c.domain
-	if len(c.ip) > 0 {
-		host = c.ip.String()
-	}
-
-	return fmt.Sprintf("%v:%v", host, c.port)
-}
-
+// UdpClient 一个会话到远程的转发, 使用未连接的socket, 按每个数据包的目的地址发送
 type UdpClient struct {
 	listenerUDP *net.UDPConn // udp转发服务的连接, 用于回复数据
 	addr        *net.UDPAddr // socks代理客户端的地址
-	h           *HandShake
+	identity    *Identity    // 会话认证后的身份
+
+	remoteConn *net.UDPConn // 发送到远程
+	config     *Config
+	dns        *dnsCache
+	wg         *sync.WaitGroup // 读取远程数据的goroutine
+
+	mu      sync.Mutex
+	peers   map[string]struct{} // 发送过的目的地址及IP, 用于过滤远程的回复
+	domains map[string]AddrByte // 解析后的地址 -> 客户端使用的域名地址, 用于 UDPEchoDomain
 
-	remoteConn *net.UDPConn // 连接远程
+	reassembler *udpReassembler // 分片重组, 为nil时不支持分片
+	fragUsed    int32           // 客户端发送过分片, 之后对超过 UDPFragReplySize 的回复分片
 
 	OnError func(err error, cli *UdpClient)
 }
 
-func (c *UdpClient) Connect(buf []byte) error {
-	h, err := c.handshake(buf)
-	if err != nil {
+// Connect 打开发送到远程的socket, 并开始接收远程的回复
+func (c *UdpClient) Connect() error {
+	var err error
+	if c.remoteConn, err = net.ListenUDP("udp", nil); err != nil {
 		return err
 	}
+	c.peers = make(map[string]struct{})
+	c.domains = make(map[string]AddrByte)
+	if !c.config.DisableUDPFrag {
+		c.reassembler = newUDPReassembler(c.config.UDPFragTimeout, c.config.UDPFragMaxSize)
+	}
 
-	c.h = h
+	c.touch()
 
-	// 连接远程
-	if tmpConn, err := net.DialTimeout("udp", h.Address(), time.Second*10); err != nil {
-		log.Printf("connect fail %v %v", h.Address(), err)
-		return err
-	} else {
-		var ok bool
-		c.remoteConn, ok = tmpConn.(*net.UDPConn)
-		if !ok {
-			return io.EOF
-		}
+	if c.wg != nil {
+		c.wg.Add(1)
 	}
-
 	go func() {
+		defer func() {
+			if c.wg != nil {
+				c.wg.Done()
+			}
+		}()
 		defer func() {
 			_ = c.remoteConn.Close()
 
-			log.Printf("dial close %v %v", c.remoteConn.LocalAddr(), c.remoteConn.RemoteAddr())
+			c.config.Logger.Printf("udp relay close %v for %v", c.remoteConn.LocalAddr(), c.addr)
 		}()
 
-		log.Printf("new dial %v %v", c.remoteConn.LocalAddr(), c.remoteConn.RemoteAddr())
+		c.config.Logger.Printf("new udp relay %v for %v", c.remoteConn.LocalAddr(), c.addr)
 
 		var handleError = func(err error) {
 			if c.OnError != nil {
@@ -77,17 +70,23 @@ func (c *UdpClient) Connect(buf []byte) error {
 		// 读取远程数据
 		buffer := make([]byte, 65535)
 		for {
-			n, _, err := c.remoteConn.ReadFromUDP(buffer)
+			n, fromAddr, err := c.remoteConn.ReadFromUDP(buffer)
 			if err != nil {
 				handleError(err)
 				return
 			}
+			c.touch()
 
-			body := append(h.header, buffer[:n]...)
+			if !c.acceptFrom(fromAddr) {
+				continue
+			}
 
-			// 转发给socks客户端
-			_, err = c.listenerUDP.WriteToUDP(body, c.addr)
+			header, err := c.replyAddr(fromAddr)
 			if err != nil {
+				continue
+			}
+			// 转发给socks客户端
+			if err = c.reply(header, buffer[:n]); err != nil {
 				handleError(err)
 				return
 			}
@@ -97,83 +96,490 @@ func (c *UdpClient) Connect(buf []byte) error {
 	return nil
 }
 
+// reply 转发给socks客户端. 客户端使用过分片时, 超过 UDPFragReplySize 的回复分片发送
+func (c *UdpClient) reply(header AddrByte, data []byte) error {
+	body := NewUDPDatagram(header, data).ToBytes()
+
+	size := c.config.UDPFragReplySize
+	if size > 0 && len(body) > size && atomic.LoadInt32(&c.fragUsed) == 1 {
+		if packets := fragmentUDP(header, data, size); packets != nil {
+			for _, p := range packets {
+				if _, err := c.listenerUDP.WriteToUDP(p, c.addr); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	_, err := c.listenerUDP.WriteToUDP(body, c.addr)
+	return err
+}
+
+// touch 有数据收发时延长空闲超时, 超时后读取goroutine退出并关闭socket
+func (c *UdpClient) touch() {
+	if c.config.UDPIdleTimeout > 0 {
+		_ = c.remoteConn.SetReadDeadline(time.Now().Add(c.config.UDPIdleTimeout))
+	}
+}
+
+// Close 关闭到远程的连接, 读取goroutine随之退出
+func (c *UdpClient) Close() {
+	if c.remoteConn != nil {
+		_ = c.remoteConn.Close()
+	}
+	if c.reassembler != nil {
+		c.reassembler.close()
+	}
+}
+
+// Handle 转发给数据包中的目的地址
 func (c *UdpClient) Handle(buf []byte) error {
-	h, err := c.handshake(buf)
+	d, err := NewUDPDatagramFromBytes(buf)
 	if err != nil {
 		return err
 	}
 
+	// 分片, 序列结束时使用最后一个分片的目的地址转发
+	body := d.Data
+	if d.Frag != 0 {
+		if c.reassembler == nil {
+			return ErrUDPFrag
+		}
+		atomic.StoreInt32(&c.fragUsed, 1)
+
+		var complete bool
+		if body, complete, err = c.reassembler.add(d.Frag, d.Data); err != nil || !complete {
+			return err
+		}
+	} else if c.reassembler != nil {
+		// 独立的数据包, FRAG小于已处理的分片, 放弃未完成的序列 (RFC 1928 第7节)
+		c.reassembler.close()
+	}
+
+	addr := d.AddrByte()
+	ips, err := c.allow(addr)
+	if err != nil {
+		return err
+	}
+
+	dst, err := c.resolve(addr, ips)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.peers[dst.String()] = struct{}{}
+	c.peers[dst.IP.String()] = struct{}{}
+	if d.AType == ATypDomain && c.config.UDPEchoDomain {
+		c.domains[dst.String()] = append(AddrByte(nil), addr...)
+	}
+	c.mu.Unlock()
+
 	// 转发给远程
-	_, err = c.remoteConn.Write(h.body)
+	c.touch()
+	_, err = c.remoteConn.WriteToUDP(body, dst)
 
 	return err
 }
 
-func (c *UdpClient) handshake(buf []byte) (*HandShake, error) {
-	var (
-		rsv  [2]byte
-		flag byte
-	)
+// resolve 目的地址, ips为规则检查时解析的地址, 为空时使用缓存解析. 配置了EgressGuard时检查所有地址
+func (c *UdpClient) resolve(addr AddrByte, ips []net.IP) (*net.UDPAddr, error) {
+	host, port := addr.HostPort()
+
+	if len(ips) == 0 {
+		var err error
+		if ips, err = c.lookup(host); err != nil {
+			return nil, err
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("can't resolve domain: %v", host)
+	}
+
+	if c.config.EgressGuard != nil {
+		if err := c.config.EgressGuard.CheckAll(host, ips); err != nil {
+			return nil, err
+		}
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, nil
+}
+
+// replyAddr 回复数据包头中的地址, 为远程的实际地址.
+// 配置了UDPEchoDomain且该地址是客户端请求的域名解析得到的, 使用客户端请求的域名
+func (c *UdpClient) replyAddr(from *net.UDPAddr) (AddrByte, error) {
+	if c.config.UDPEchoDomain {
+		c.mu.Lock()
+		header, ok := c.domains[from.String()]
+		c.mu.Unlock()
+		if ok {
+			return header, nil
+		}
+	}
+
+	return NewAddrByteFromString(from.String())
+}
 
-	if len(buf) < 4 || !bytes.Equal(buf[:2], rsv[:]) || buf[2] != flag {
-		return nil, errors.New("fail")
+// acceptFrom 按配置的过滤方式检查远程的回复
+func (c *UdpClient) acceptFrom(from *net.UDPAddr) bool {
+	var key string
+	switch c.config.UDPFiltering {
+	case UDPFilterEndpointIndependent:
+		return true
+	case UDPFilterAddressDependent:
+		key = from.IP.String()
+	default:
+		key = from.String()
 	}
 
-	var header, body []byte
-	var aTyp = buf[3]
+	c.mu.Lock()
+	_, ok := c.peers[key]
+	c.mu.Unlock()
+	return ok
+}
+
+// allow 规则检查, 拒绝的数据包丢弃. 规则需要目的IP时先解析域名, 返回检查过的地址
+func (c *UdpClient) allow(addr AddrByte) ([]net.IP, error) {
+	if c.config.Rules == nil {
+		return nil, nil
+	}
 
-	var (
-		ip     net.IP
-		port   int
-		domain string
-	)
+	r := NewRuleRequest(c.addr, c.identity, CmdUdpAssociate, addr)
 
-	switch aTyp {
-	case ATypIPv4:
-		if len(buf) < 10 {
-			return nil, errors.New("header is too short for IPv4")
+	var ips []net.IP
+	if r.Host != "" && needIP(c.config.Rules) {
+		var err error
+		if ips, err = c.lookup(r.Host); err != nil {
+			return nil, err
 		}
-		ip = net.IPv4(buf[4], buf[5], buf[6], buf[7])
-		port = int(binary.BigEndian.Uint16(buf[8:10]))
-		body = buf[10:]
-		header = buf[:10]
-	case ATypDomain:
-		if len(buf) < 5 {
-			return nil, errors.New("header is too short for domain")
+	}
+
+	allow, rule := allowResolved(c.config.Rules, r, ips)
+	if !allow {
+		c.config.Logger.Printf("udp %v denied by rule %v", r, rule)
+		return nil, ErrRuleDenied
+	}
+	return ips, nil
+}
+
+// lookup 使用缓存解析域名
+func (c *UdpClient) lookup(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.DialTimeout)
+	defer cancel()
+
+	return c.dns.lookup(ctx, host)
+}
+
+// udpAssociation 一个UDP ASSOCIATE会话, 生命周期与TCP控制连接相同
+type udpAssociation struct {
+	owner     *udpAssociations
+	identity  *Identity
+	clientIP  net.IP // TCP控制连接的客户端IP, 只接受该IP的数据
+	hintPort  int    // 请求中的DST.PORT, 不为0时只接受该端口的数据. DST.ADDR不使用, 见newUDPAssociation
+	dedicated bool   // 使用独立端口, 不在共享端口上查找
+
+	mu     sync.Mutex
+	addr   *net.UDPAddr // 第一个数据包的来源地址, 之后只接受该地址的数据
+	client *UdpClient
+	closed bool
+	queue  chan []byte   // 待转发的数据, 由会话自己的goroutine处理
+	done   chan struct{} // 会话结束
+}
+
+// newUDPAssociation hint为请求中的DST.ADDR/DST.PORT. 只使用端口, 地址总是使用TCP控制连接的客户端IP:
+// NAT后的客户端通常发送内网地址, 而其他地址又会让客户端为第三方地址开启转发
+func newUDPAssociation(identity *Identity, clientIP net.IP, hint AddrByte) *udpAssociation {
+	a := &udpAssociation{
+		identity: identity,
+		clientIP: clientIP,
+	}
+
+	_, port := hint.HostPort()
+	a.hintPort = port
+	return a
+}
+
+// accept 来源地址是否属于该会话
+func (a *udpAssociation) accept(from *net.UDPAddr) bool {
+	if !a.clientIP.Equal(from.IP) {
+		return false
+	}
+	return a.hintPort == 0 || a.hintPort == from.Port
+}
+
+// bind 独立端口模式下检查来源地址, 第一个数据包确定会话的来源地址
+func (a *udpAssociation) bind(from *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.addr != nil {
+		return a.addr.IP.Equal(from.IP) && a.addr.Port == from.Port
+	}
+	if !a.accept(from) {
+		return false
+	}
+	a.addr = from
+	return true
+}
+
+// enqueue 把数据放入会话的队列, 队列满时丢弃, 不阻塞共享的读取goroutine.
+// 第一个数据包时启动会话的转发goroutine
+func (a *udpAssociation) enqueue(listenerUDP *net.UDPConn, from *net.UDPAddr, data []byte, config *Config, wg *sync.WaitGroup) bool {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return false
+	}
+	if a.queue == nil {
+		a.queue = make(chan []byte, config.UDPQueueSize)
+		a.done = make(chan struct{})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.run(listenerUDP, from, config, wg)
+		}()
+	}
+	queue := a.queue
+	a.mu.Unlock()
+
+	// data 引用读取缓冲区, 需要复制
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	select {
+	case queue <- buf:
+		return true
+	default:
+		atomic.AddInt64(&a.owner.dropped, 1)
+		return false
+	}
+}
+
+// run 依次转发队列中的数据, 解析域名及打开socket都在这里进行
+func (a *udpAssociation) run(listenerUDP *net.UDPConn, from *net.UDPAddr, config *Config, wg *sync.WaitGroup) {
+	for {
+		select {
+		case <-a.done:
+			return
+		case data := <-a.queue:
+			if err := a.handle(listenerUDP, from, data, config, wg); err != nil && err != ErrServerClosed {
+				config.Logger.Println(err)
+			}
+		}
+	}
+}
+
+// handle 转发客户端的数据, 第一个数据包时打开到远程的socket
+func (a *udpAssociation) handle(listenerUDP *net.UDPConn, from *net.UDPAddr, data []byte, config *Config, wg *sync.WaitGroup) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrServerClosed
+	}
+
+	cli := a.client
+	if cli == nil {
+		cli = &UdpClient{
+			listenerUDP: listenerUDP,
+			addr:        from,
+			identity:    a.identity,
+			config:      config,
+			dns:         a.owner.dns,
+			wg:          wg,
+			OnError: func(err error, c *UdpClient) {
+				a.mu.Lock()
+				if a.client == c {
+					a.client = nil
+				}
+				a.mu.Unlock()
+
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					atomic.AddInt64(&a.owner.idleEvictions, 1)
+					config.Logger.Printf("udp relay for %v idle timeout", c.addr)
+				}
+			},
 		}
-		domainLen := int(buf[4])
-		if domainLen <= 0 || len(buf) < 5+domainLen+2 {
-			return nil, errors.New("header is too short for domain")
+
+		if err := cli.Connect(); err != nil {
+			a.mu.Unlock()
+			return err
 		}
-		domain = string(buf[5 : 5+domainLen])
-		if ipAddr, err := net.ResolveIPAddr("ip", domain); err != nil {
-			// return nil, errors.New("can't resolve domain:" + domain)
-		} else {
-			ip = ipAddr.IP
-		}
-		port = int(binary.BigEndian.Uint16(buf[5+domainLen : 5+domainLen+2]))
-		body = buf[5+domainLen+2:]
-		header = buf[:5+domainLen+2]
-	case ATypIPv6:
-		if len(buf) < 22 {
-			return nil, errors.New("header is too short for IPv6")
-		}
-		ip = net.ParseIP(string(buf[4:20]))
-		port = int(binary.BigEndian.Uint16(buf[20:22]))
-		body = buf[22:]
-		header = buf[:22]
-	default:
-		return nil, errors.New("unsupported aTyp")
+		a.client = cli
+	}
+	a.mu.Unlock()
+
+	// 转发数据
+	return cli.Handle(data)
+}
+
+// close 控制连接关闭时结束会话
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+	a.closed = true
+	if a.done != nil {
+		close(a.done)
+	}
+	if a.client != nil {
+		a.client.Close()
+		a.client = nil
+	}
+}
+
+// UDPStats UDP会话统计
+type UDPStats struct {
+	Sessions      int64 // 当前会话数
+	Rejected      int64 // 超过会话上限拒绝的请求数
+	IdleEvictions int64 // 空闲超时关闭的转发数
+	Dropped       int64 // 会话队列满丢弃的数据包数
+	Unassociated  int64 // 不属于任何会话丢弃的数据包数
+}
+
+// udpAssociations 会话统计及上限, 单端口模式下按来源地址查找会话
+type udpAssociations struct {
+	maxSessions        int
+	maxSessionsPerUser int
+	dns                *dnsCache
+
+	mu      sync.Mutex
+	pending map[string][]*udpAssociation // 客户端IP -> 还没有收到数据的会话
+	bound   map[string]*udpAssociation   // 来源地址 -> 会话
+	perUser map[string]int
+
+	sessions      int64
+	rejected      int64
+	idleEvictions int64
+	dropped       int64
+	unassociated  int64
+}
+
+func newUDPAssociations(config *Config, dns *dnsCache) *udpAssociations {
+	return &udpAssociations{
+		maxSessions:        config.MaxUDPSessions,
+		maxSessionsPerUser: config.MaxUDPSessionsPerUser,
+		dns:                dns,
+		pending:            make(map[string][]*udpAssociation),
+		bound:              make(map[string]*udpAssociation),
+		perUser:            make(map[string]int),
+	}
+}
+
+// add 注册会话, 超过会话上限时返回错误
+func (p *udpAssociations) add(a *udpAssociation) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var user string
+	if a.identity != nil {
+		user = a.identity.User
+	}
+
+	if p.maxSessions > 0 && atomic.LoadInt64(&p.sessions) >= int64(p.maxSessions) {
+		atomic.AddInt64(&p.rejected, 1)
+		return ErrUDPSessionLimit
+	}
+	if user != "" && p.maxSessionsPerUser > 0 && p.perUser[user] >= p.maxSessionsPerUser {
+		atomic.AddInt64(&p.rejected, 1)
+		return fmt.Errorf("%w: user %v", ErrUDPSessionLimit, user)
+	}
+
+	a.owner = p
+	atomic.AddInt64(&p.sessions, 1)
+	if user != "" {
+		p.perUser[user]++
+	}
+
+	if !a.dedicated {
+		key := a.clientIP.String()
+		p.pending[key] = append(p.pending[key], a)
+	}
+	return nil
+}
+
+func (p *udpAssociations) stats() UDPStats {
+	return UDPStats{
+		Sessions:      atomic.LoadInt64(&p.sessions),
+		Rejected:      atomic.LoadInt64(&p.rejected),
+		IdleEvictions: atomic.LoadInt64(&p.idleEvictions),
+		Dropped:       atomic.LoadInt64(&p.dropped),
+		Unassociated:  atomic.LoadInt64(&p.unassociated),
+	}
+}
+
+// dropUnassociated 记录不属于任何会话的数据包. 未认证的来源也能发送, 只计数不记录日志
+func (p *udpAssociations) dropUnassociated() {
+	atomic.AddInt64(&p.unassociated, 1)
+}
+
+// remove 删除会话并关闭到远程的连接
+func (p *udpAssociations) remove(a *udpAssociation) {
+	p.mu.Lock()
+	key := a.clientIP.String()
+	list := p.pending[key]
+	for i, v := range list {
+		if v == a {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(p.pending, key)
+	} else {
+		p.pending[key] = list
+	}
+
+	a.mu.Lock()
+	if a.addr != nil && p.bound[a.addr.String()] == a {
+		delete(p.bound, a.addr.String())
 	}
+	a.mu.Unlock()
+
+	atomic.AddInt64(&p.sessions, -1)
+	if a.identity != nil && a.identity.User != "" {
+		if p.perUser[a.identity.User]--; p.perUser[a.identity.User] <= 0 {
+			delete(p.perUser, a.identity.User)
+		}
+	}
+	p.mu.Unlock()
+
+	a.close()
+}
 
-	h := make([]byte, len(header))
-	copy(h, header)
+// lookup 查找来源地址所属的会话, 没有时返回nil. 第一个数据包确定会话的来源地址
+func (p *udpAssociations) lookup(from *net.UDPAddr) *udpAssociation {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	return &HandShake{
-		header: h,
-		body:   body,
-		ip:     ip,
-		port:   port,
-		domain: domain,
-	}, nil
+	key := from.String()
+	if a, ok := p.bound[key]; ok {
+		return a
+	}
+
+	ipKey := from.IP.String()
+	list := p.pending[ipKey]
+	for i, a := range list {
+		if !a.accept(from) {
+			continue
+		}
+
+		list = append(list[:i:i], list[i+1:]...)
+		if len(list) == 0 {
+			delete(p.pending, ipKey)
+		} else {
+			p.pending[ipKey] = list
+		}
+
+		a.mu.Lock()
+		a.addr = from
+		a.mu.Unlock()
+		p.bound[key] = a
+		return a
+	}
+
+	return nil
 }
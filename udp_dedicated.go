@@ -0,0 +1,87 @@
+package go_socks5
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// handleUDPDedicated 独立端口模式的UDP ASSOCIATE: 会话单独监听一个端口, 控制连接关闭时关闭
+func (c *connection) handleUDPDedicated(assoc *udpAssociation) {
+	conn, err := c.listenUDP()
+	if err != nil {
+		_ = c.reply(RepServerFailure, nil)
+		c.logger.Printf("udp associate listen: %v", err)
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if !c.setTarget(conn) {
+		return
+	}
+
+	bndAddr, err := c.dedicatedReplyAddr(conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		_ = c.reply(RepServerFailure, nil)
+		c.logger.Println(err)
+		return
+	}
+	if err = c.reply(RepSuccess, bndAddr); err != nil {
+		c.logger.Println(err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		buffer := make([]byte, 65535)
+		for {
+			n, fromAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			if !assoc.bind(fromAddr) {
+				c.associations.dropUnassociated()
+				continue
+			}
+			assoc.enqueue(conn, fromAddr, buffer[:n], c.config, &wg)
+		}
+	}()
+
+	c.waitClose()
+
+	// 先结束会话, 转发goroutine随之退出
+	_ = conn.Close()
+	assoc.close()
+	wg.Wait()
+}
+
+// listenUDP 在客户端连接的本地地址及配置的端口范围内监听
+func (c *connection) listenUDP() (*net.UDPConn, error) {
+	var ip net.IP
+	if local, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+		ip = local.IP
+	}
+
+	var conn *net.UDPConn
+	err := listenPorts(c.config.udpPorts, func(port int) (err error) {
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		return err
+	})
+	return conn, err
+}
+
+// dedicatedReplyAddr 回复的地址. 配置了 UDPAdvertiseAddr 时使用其中的IP及监听的端口
+func (c *connection) dedicatedReplyAddr(local *net.UDPAddr) (AddrByte, error) {
+	isIPv6 := local.IP != nil && local.IP.To4() == nil
+	if adv := c.config.advertiseAddr(isIPv6); adv != nil {
+		host, _ := adv.HostPort()
+		return NewAddrByteFromString(net.JoinHostPort(host, strconv.Itoa(local.Port)))
+	}
+	return NewAddrByteFromString(local.String())
+}
@@ -0,0 +1,131 @@
+package go_socks5
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	udpFragEnd    byte = 0x80 // 分片序列结束
+	udpFragMaxPos      = 0x7f
+)
+
+// udpReassembler 一个会话的分片重组队列及定时器 (RFC 1928 第7节).
+// 分片必须按顺序到达, 乱序、超时或超过大小限制时丢弃整个序列
+type udpReassembler struct {
+	timeout time.Duration
+	maxSize int
+
+	mu    sync.Mutex
+	last  byte // 当前序列最后收到的分片位置, 0表示没有序列
+	parts [][]byte
+	size  int
+	seq   int // 序列编号, 避免过期的定时器清除新的序列
+	timer *time.Timer
+}
+
+func newUDPReassembler(timeout time.Duration, maxSize int) *udpReassembler {
+	return &udpReassembler{
+		timeout: timeout,
+		maxSize: maxSize,
+	}
+}
+
+// add 加入一个分片, 序列结束时返回重组后的数据
+func (r *udpReassembler) add(frag byte, data []byte) ([]byte, bool, error) {
+	pos := frag & udpFragMaxPos
+	end := frag&udpFragEnd != 0
+	if pos == 0 {
+		return nil, false, ErrUDPFrag
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pos == 1 {
+		// 新的序列
+		r.resetLocked()
+		r.seq++
+		seq := r.seq
+		r.timer = time.AfterFunc(r.timeout, func() {
+			r.mu.Lock()
+			if r.seq == seq {
+				r.resetLocked()
+			}
+			r.mu.Unlock()
+		})
+	} else if r.last == 0 || pos != r.last+1 {
+		r.resetLocked()
+		return nil, false, fmt.Errorf("%w: out of order fragment %d", ErrUDPFrag, pos)
+	}
+
+	if r.size+len(data) > r.maxSize {
+		r.resetLocked()
+		return nil, false, fmt.Errorf("%w: reassembly exceeds %d bytes", ErrUDPFrag, r.maxSize)
+	}
+
+	// data 引用读取缓冲区, 需要复制
+	part := make([]byte, len(data))
+	copy(part, data)
+	r.parts = append(r.parts, part)
+	r.size += len(part)
+	r.last = pos
+
+	if !end {
+		return nil, false, nil
+	}
+
+	body := make([]byte, 0, r.size)
+	for _, p := range r.parts {
+		body = append(body, p...)
+	}
+	r.resetLocked()
+	return body, true, nil
+}
+
+func (r *udpReassembler) close() {
+	r.mu.Lock()
+	r.resetLocked()
+	r.mu.Unlock()
+}
+
+func (r *udpReassembler) resetLocked() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.last = 0
+	r.parts = nil
+	r.size = 0
+}
+
+// fragmentUDP 把数据分片, 每个数据包不超过size. 无法分片(包头过大或超过127片)时返回nil
+func fragmentUDP(header AddrByte, data []byte, size int) [][]byte {
+	payload := size - 3 - len(header)
+	if payload <= 0 {
+		return nil
+	}
+
+	n := (len(data) + payload - 1) / payload
+	if n > udpFragMaxPos {
+		return nil
+	}
+
+	var packets [][]byte
+	for i := 0; i < n; i++ {
+		start := i * payload
+		end := start + payload
+		if end > len(data) {
+			end = len(data)
+		}
+
+		d := NewUDPDatagram(header, data[start:end])
+		d.Frag = byte(i + 1)
+		if i == n-1 {
+			d.Frag |= udpFragEnd
+		}
+		packets = append(packets, d.ToBytes())
+	}
+	return packets
+}